@@ -3,6 +3,7 @@ package maimai
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -17,49 +18,116 @@ type SenderReceiver interface {
 	connect(r *Room) error
 	start(r *Room, inbound chan *PacketEvent, outbound chan *PacketEvent)
 	stop()
+	// reconnect drops the connection, to be connected again. It may be
+	// called from any goroutine.
+	reconnect()
+	// openPM returns a SenderReceiver for the private message room with the
+	// given ID, on the same server.
+	openPM(pmID string) SenderReceiver
 }
 
 type WSSenderReceiver struct {
-	conn     *websocket.Conn
+	// connMu guards conn and newConn, which is closed and replaced when conn
+	// is replaced by a new connection. Only the receiver reconnects; the
+	// sender and reconnect close the connection for the receiver to find.
+	connMu  sync.Mutex
+	conn    *websocket.Conn
+	newConn chan empty
+
 	Room     string
 	stopChan chan empty
 	wg       sync.WaitGroup
 	logger   *logrus.Logger
+
+	// Host is the euphoria server to connect to. A failed connection is
+	// retried up to ConnectRetries times, waiting RetryDelay longer each time.
+	Host           string
+	ConnectRetries int
+	RetryDelay     time.Duration
+
+	// Cookies, if not nil, are sent when connecting and updated with the
+	// cookies the server sets.
+	Cookies *CookieFile
+
+	// PMID, if set, is the ID of the private message room to connect to
+	// instead of Room.
+	PMID string
 }
 
 func NewWSSenderReceiver(room string, logger *logrus.Logger) *WSSenderReceiver {
 	return &WSSenderReceiver{
-		Room:     room,
-		stopChan: make(chan empty, 2),
-		logger:   logger,
+		Room:           room,
+		newConn:        make(chan empty),
+		stopChan:       make(chan empty, 2),
+		logger:         logger,
+		Host:           defaultHost,
+		ConnectRetries: defaultConnectRetries,
+		RetryDelay:     defaultRetryDelay,
 	}
 }
 
 func (ws *WSSenderReceiver) connectOnce(r *Room) error {
 	ws.logger.Debug("Attempting connection...")
-	tlsConn, err := tls.Dial("tcp", "euphoria.io:443", &tls.Config{})
+	tlsConn, err := tls.Dial("tcp", ws.Host+":443", &tls.Config{})
 	if err != nil {
 		ws.logger.Error("Error connecting via tls.")
 		return err
 	}
-	roomURL, err := url.Parse(fmt.Sprintf("wss://euphoria.io/room/%s/ws", ws.Room))
+	path := "room/" + ws.Room
+	if ws.PMID != "" {
+		path = "pm/" + ws.PMID
+	}
+	roomURL, err := url.Parse(fmt.Sprintf("wss://%s/%s/ws", ws.Host, path))
 	if err != nil {
 		return err
 	}
-	wsConn, _, err := websocket.NewClient(tlsConn, roomURL, http.Header{}, 4096, 4096)
+	header := http.Header{}
+	if ws.Cookies != nil {
+		header = ws.Cookies.Header()
+	}
+	wsConn, resp, err := websocket.NewClient(tlsConn, roomURL, header, 4096, 4096)
 	if err != nil {
 		ws.logger.Error("Error connecting via websocket.")
 		return err
 	}
+	if ws.Cookies != nil {
+		if err := ws.Cookies.Update(resp.Cookies()); err != nil {
+			ws.logger.Errorf("Error saving cookies: %s", err)
+		}
+	}
 	ws.logger.Debug("Connection success.")
+	ws.connMu.Lock()
+	if ws.conn != nil {
+		ws.conn.Close()
+	}
 	ws.conn = wsConn
+	close(ws.newConn)
+	ws.newConn = make(chan empty)
+	ws.connMu.Unlock()
 	return nil
 }
 
+// currentConn returns the connection and a channel closed once it has been
+// replaced.
+func (ws *WSSenderReceiver) currentConn() (*websocket.Conn, chan empty) {
+	ws.connMu.Lock()
+	defer ws.connMu.Unlock()
+	return ws.conn, ws.newConn
+}
+
+// closeConn closes conn if it is still the current connection.
+func (ws *WSSenderReceiver) closeConn(conn *websocket.Conn) {
+	ws.connMu.Lock()
+	defer ws.connMu.Unlock()
+	if conn != nil && conn == ws.conn {
+		conn.Close()
+	}
+}
+
 func (ws *WSSenderReceiver) connect(r *Room) error {
 	if err := ws.connectOnce(r); err != nil {
-		for i := 0; i < 5; i++ {
-			time.Sleep(time.Duration(i+1) * time.Second * 10)
+		for i := 0; i < ws.ConnectRetries; i++ {
+			time.Sleep(time.Duration(i+1) * ws.RetryDelay)
 			err = ws.connectOnce(r)
 			if err == nil {
 				break
@@ -69,23 +137,45 @@ func (ws *WSSenderReceiver) connect(r *Room) error {
 			return err
 		}
 	}
-	if r.config.Password != "" {
-		r.Logger.Debugln("Sending auth.")
-		r.SendAuth()
-	}
-	time.Sleep(time.Second)
-	r.Logger.Debugln("Sending nick.")
-	r.SendNick(r.config.Nick)
+	// The nick is sent once the server lets the bot in; see Room.trackSession.
+	r.beginSetup()
 	return nil
 }
 
-func (ws *WSSenderReceiver) sendJSON(r *Room, msg interface{}) error {
-	if err := ws.conn.WriteJSON(msg); err != nil {
-		if err = ws.connect(r); err != nil {
-			return err
+// reconnect closes the connection, which the receiver then finds closed and
+// connects again.
+func (ws *WSSenderReceiver) reconnect() {
+	conn, _ := ws.currentConn()
+	ws.closeConn(conn)
+}
+
+func (ws *WSSenderReceiver) openPM(pmID string) SenderReceiver {
+	pm := NewWSSenderReceiver(ws.Room, ws.logger)
+	pm.Host = ws.Host
+	pm.ConnectRetries = ws.ConnectRetries
+	pm.RetryDelay = ws.RetryDelay
+	pm.Cookies = ws.Cookies
+	pm.PMID = pmID
+	return pm
+}
+
+// errSenderStopped is returned by sendJSON if the sender is stopped while
+// waiting for the receiver to reconnect.
+var errSenderStopped = errors.New("sender stopped")
+
+// sendJSON sends msg, closing the connection on failure and sending it again
+// once the receiver has reconnected.
+func (ws *WSSenderReceiver) sendJSON(msg interface{}) error {
+	conn, newConn := ws.currentConn()
+	if err := conn.WriteJSON(msg); err != nil {
+		ws.closeConn(conn)
+		select {
+		case <-newConn:
+		case <-ws.stopChan:
+			return errSenderStopped
 		}
-		err = ws.conn.WriteJSON(msg)
-		return err
+		conn, _ = ws.currentConn()
+		return conn.WriteJSON(msg)
 	}
 	return nil
 }
@@ -97,7 +187,9 @@ func (ws *WSSenderReceiver) sender(r *Room, outbound chan *PacketEvent) {
 //			if msg.Type != PingReplyType {
 				r.Logger.Debugf("Sending packet of type %s and ID %s", msg.Type, msg.ID)
 		//	}
-			if err := ws.sendJSON(r, msg); err != nil {
+			if err := ws.sendJSON(msg); err == errSenderStopped {
+				return
+			} else if err != nil {
 				panic(err)
 			}
 		case <-ws.stopChan:
@@ -107,12 +199,14 @@ func (ws *WSSenderReceiver) sender(r *Room, outbound chan *PacketEvent) {
 }
 
 func (ws *WSSenderReceiver) receiveMessage(r *Room) (*PacketEvent, error) {
-	_, msg, err := ws.conn.ReadMessage()
+	conn, _ := ws.currentConn()
+	_, msg, err := conn.ReadMessage()
 	if err != nil {
 		if err = ws.connect(r); err != nil {
 			return &PacketEvent{}, err
 		}
-		_, msg, err = ws.conn.ReadMessage()
+		conn, _ = ws.currentConn()
+		_, msg, err = conn.ReadMessage()
 		if err != nil {
 			return &PacketEvent{}, err
 		}
@@ -0,0 +1,156 @@
+package maimai
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const adminUsage = "Usage: !admin nick <nick> | reload | disable <handler> | pause <handler> | resume <handler> | shutdown"
+
+// The admin handler reconfigures rooms, which looks handlers up in the
+// registry, so it is registered here rather than in the registry's literal.
+func init() {
+	RegisterHandler("admin", Handler(AdminCommandHandler))
+}
+
+// AdminAuditEntry records an admin command given to the bot. Entries are kept
+// in the admin handler's KV, keyed by the time they were given.
+type AdminAuditEntry struct {
+	Time     int64  `json:"time"`
+	UserID   string `json:"userID"`
+	UserName string `json:"userName"`
+	Command  string `json:"command"`
+	Allowed  bool   `json:"allowed"`
+	Result   string `json:"result"`
+}
+
+// isOwner reports whether the user with the given ID may use admin commands.
+func (r *Room) isOwner(userID string) bool {
+	if userID == "" {
+		return false
+	}
+	for _, owner := range r.roomConfig().Owners {
+		if owner == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Room) auditAdminCommand(entry *AdminAuditEntry) {
+	key := fmt.Sprintf("%020d", time.Now().UnixNano())
+	if err := r.KV("admin").PutJSON(key, entry); err != nil {
+		r.Logger.Errorf("Error recording admin command in audit log: %s", err)
+	}
+}
+
+// AdminAuditLog returns every admin command recorded in the audit log, oldest first.
+func (r *Room) AdminAuditLog() ([]AdminAuditEntry, error) {
+	var entries []AdminAuditEntry
+	err := r.KV("admin").ForEach(func(key string, value []byte) error {
+		var entry AdminAuditEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// runAdminCommand carries out an admin command given as the fields after
+// "!admin", returning the reply to send. Shutdown is left to the caller, so
+// that the reply can be sent first, and is requested by returning true.
+func (r *Room) runAdminCommand(args []string) (string, bool) {
+	if len(args) == 0 {
+		return adminUsage, false
+	}
+	switch {
+	case args[0] == "nick" && len(args) == 2:
+		if _, err := r.SetNick(args[1]); err != nil {
+			return fmt.Sprintf("Could not change nick: %s", err), false
+		}
+		return fmt.Sprintf("Nick changed to %s.", args[1]), false
+	case args[0] == "reload" && len(args) == 1:
+		report, err := r.Reload()
+		if err != nil {
+			return fmt.Sprintf("Could not reload config: %s", err), false
+		}
+		return report.String(), false
+	case args[0] == "disable" && len(args) == 2:
+		if err := r.DisableHandler(args[1]); err != nil {
+			return err.Error(), false
+		}
+		return fmt.Sprintf("Disabled handler %s.", args[1]), false
+	case args[0] == "pause" && len(args) == 2:
+		if err := r.PauseHandler(args[1]); err != nil {
+			return err.Error(), false
+		}
+		return fmt.Sprintf("Paused handler %s.", args[1]), false
+	case args[0] == "resume" && len(args) == 2:
+		if err := r.ResumeHandler(args[1]); err != nil {
+			return err.Error(), false
+		}
+		return fmt.Sprintf("Resumed handler %s.", args[1]), false
+	case args[0] == "shutdown" && len(args) == 1:
+		return "Shutting down.", true
+	}
+	return adminUsage, false
+}
+
+// AdminCommandHandler handles a send-event and, if one of the room's owners
+// gave an !admin command, carries it out and replies with the result. Every
+// admin command, allowed or not, is recorded in the audit log.
+func AdminCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := handlerPayload[Message](room, &packet)
+			if data == nil {
+				continue
+			}
+			fields := strings.Fields(data.Content)
+			if len(fields) == 0 || fields[0] != "!admin" {
+				continue
+			}
+			// Admin commands given in a PM act on the room it was opened from,
+			// whose owners may give them.
+			target := room
+			if parent := room.Parent(); parent != nil {
+				target = parent
+			}
+			entry := &AdminAuditEntry{
+				Time:     time.Now().Unix(),
+				UserID:   data.Sender.ID,
+				UserName: data.Sender.Name,
+				Command:  data.Content,
+				Allowed:  target.isOwner(data.Sender.ID)}
+			if !entry.Allowed {
+				entry.Result = "denied"
+				room.auditAdminCommand(entry)
+				room.SendText("You are not allowed to use admin commands.", data.ID)
+				continue
+			}
+			// Admin commands wait on the dispatcher, which may be waiting to
+			// send this handler a packet, so they are run in their own goroutine.
+			go func(msgID string) {
+				var shutdown bool
+				entry.Result, shutdown = target.runAdminCommand(fields[1:])
+				room.auditAdminCommand(entry)
+				room.SendText(entry.Result, msgID)
+				if shutdown {
+					target.Stop()
+				}
+			}(data.ID)
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
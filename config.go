@@ -0,0 +1,463 @@
+package maimai
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Defaults for values left unset in a config file.
+const (
+	defaultNick           = "MaiMai"
+	defaultLogPath        = "maimai.log"
+	defaultLogLevel       = "debug"
+	defaultHost           = "euphoria.io"
+	defaultConnectRetries = 5
+	defaultRetryDelay     = 10 * time.Second
+)
+
+// Duration is a time.Duration written in config files as a string such as
+// "90s" or "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"1h30m\"")
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = dur
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Config describes a bot process: the rooms it joins, how it connects and
+// where it logs. It is read from a JSON file with LoadConfig.
+type Config struct {
+	Logging   LoggingConfig    `json:"logging"`
+	Transport TransportConfig  `json:"transport"`
+	Rooms     []RoomFileConfig `json:"rooms"`
+
+	path   string
+	lines  map[string]int
+	values []jsonValue
+}
+
+// LoggingConfig configures the process-wide logger.
+type LoggingConfig struct {
+	Path   string `json:"path"`
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// TransportConfig configures the websocket connection to euphoria.
+type TransportConfig struct {
+	Host           string   `json:"host"`
+	ConnectRetries int      `json:"connect_retries"`
+	RetryDelay     Duration `json:"retry_delay"`
+}
+
+// RoomFileConfig is the configuration of one room in a config file.
+type RoomFileConfig struct {
+	Room           string                     `json:"room"`
+	Nick           string                     `json:"nick"`
+	Password       string                     `json:"password"`
+	Owners         []string                   `json:"owners"`
+	DBPath         string                     `json:"db"`
+	LogPath        string                     `json:"log"`
+	Join           bool                       `json:"join"`
+	MsgLog         bool                       `json:"msglog"`
+	Handlers       []string                   `json:"handlers"`
+	HandlerOptions map[string]json.RawMessage `json:"handler_options"`
+	MsgLogMaxAge   Duration                   `json:"msglog_max_age"`
+	MsgLogMaxCount int                        `json:"msglog_max_count"`
+	PruneInterval  Duration                   `json:"prune_interval"`
+
+	HandlerCrashLimit   int      `json:"handler_crash_limit"`
+	HandlerRestartDelay Duration `json:"handler_restart_delay"`
+
+	SetupTimeout Duration `json:"setup_timeout"`
+	NickSuffix   string   `json:"nick_suffix"`
+
+	PMHandlers    []string `json:"pm_handlers"`
+	MaxPMs        int      `json:"max_pms"`
+	PMIdleTimeout Duration `json:"pm_idle_timeout"`
+
+	Ignore     []string `json:"ignore"`
+	LoopLimit  int      `json:"loop_limit"`
+	LoopWindow Duration `json:"loop_window"`
+
+	Email           string `json:"email"`
+	AccountPassword string `json:"account_password"`
+	CookiePath      string `json:"cookie_file"`
+}
+
+// RoomConfig returns the RoomConfig for the room.
+func (rc *RoomFileConfig) RoomConfig() *RoomConfig {
+	return &RoomConfig{
+		DBPath:         rc.DBPath,
+		ErrorLogPath:   rc.LogPath,
+		Join:           rc.Join,
+		MsgLog:         rc.MsgLog,
+		Nick:           rc.Nick,
+		Password:       rc.Password,
+		Owners:         rc.Owners,
+		Handlers:       rc.Handlers,
+		HandlerOptions: rc.HandlerOptions,
+		MsgLogMaxAge:   rc.MsgLogMaxAge.Duration,
+		MsgLogMaxCount: rc.MsgLogMaxCount,
+		PruneInterval:  rc.PruneInterval.Duration,
+
+		HandlerCrashLimit:   rc.HandlerCrashLimit,
+		HandlerRestartDelay: rc.HandlerRestartDelay.Duration,
+
+		SetupTimeout: rc.SetupTimeout.Duration,
+		NickSuffix:   rc.NickSuffix,
+
+		PMHandlers:    rc.PMHandlers,
+		MaxPMs:        rc.MaxPMs,
+		PMIdleTimeout: rc.PMIdleTimeout.Duration,
+
+		Ignore:     rc.Ignore,
+		LoopLimit:  rc.LoopLimit,
+		LoopWindow: rc.LoopWindow.Duration,
+
+		Email:           rc.Email,
+		AccountPassword: rc.AccountPassword,
+		CookiePath:      rc.CookiePath,
+	}
+}
+
+// ConfigError is an error in a config file. Line is 0 if it is not known.
+type ConfigError struct {
+	Path string
+	Line int
+	Msg  string
+}
+
+func (ce *ConfigError) Error() string {
+	if ce.Line == 0 {
+		return fmt.Sprintf("%s: %s", ce.Path, ce.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", ce.Path, ce.Line, ce.Msg)
+}
+
+// ConfigErrors is every error found when validating a config file.
+type ConfigErrors []*ConfigError
+
+func (ce ConfigErrors) Error() string {
+	var msgs []string
+	for _, err := range ce {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// LoadConfig reads, validates and fills in defaults for the config file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(path, data)
+}
+
+// ParseConfig parses, validates and fills in defaults for a config file
+// with the given contents. path is only used in errors.
+func ParseConfig(path string, data []byte) (*Config, error) {
+	values := jsonValues(data)
+	cfg := &Config{path: path, lines: jsonLines(values), values: values}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, cfg.decodeError(data, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.SetDefaults()
+	return cfg, nil
+}
+
+func (c *Config) decodeError(data []byte, err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return &ConfigError{c.path, lineAt(data, e.Offset), e.Error()}
+	case *json.UnmarshalTypeError:
+		return &ConfigError{c.path, c.lines[e.Field],
+			fmt.Sprintf("%s must be of type %s, not %s", e.Field, e.Type, e.Value)}
+	}
+	msg := err.Error()
+	if strings.HasPrefix(msg, "json: unknown field ") {
+		field, _ := strconv.Unquote(strings.TrimPrefix(msg, "json: unknown field "))
+		// Decoding stops at the first unknown field, so it is the first
+		// value with that name not in a Config.
+		for _, v := range c.values {
+			if v.path[strings.LastIndex(v.path, ".")+1:] == field && configType(v.path) == nil {
+				return &ConfigError{c.path, v.line, fmt.Sprintf("unknown field \"%s\"", v.path)}
+			}
+		}
+	}
+	// Errors from Duration.UnmarshalJSON say nothing of where the value is.
+	for _, v := range c.values {
+		if configType(v.path) != durationType {
+			continue
+		}
+		s, _ := v.tok.(string)
+		if _, err := time.ParseDuration(s); err != nil {
+			return &ConfigError{c.path, v.line, fmt.Sprintf("%s: %s", v.path, msg)}
+		}
+	}
+	return &ConfigError{c.path, 0, msg}
+}
+
+func (c *Config) errorf(errs *ConfigErrors, path string, format string, args ...interface{}) {
+	*errs = append(*errs, &ConfigError{c.path, c.lines[path], fmt.Sprintf(format, args...)})
+}
+
+// Validate checks the config for errors that decoding it cannot catch, such
+// as unknown handlers, returning all of them as ConfigErrors.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	if c.Logging.Level != "" {
+		if _, err := logrus.ParseLevel(c.Logging.Level); err != nil {
+			c.errorf(&errs, "logging.level", "unknown log level \"%s\"", c.Logging.Level)
+		}
+	}
+	switch c.Logging.Format {
+	case "", "json", "text":
+	default:
+		c.errorf(&errs, "logging.format", "log format must be \"json\" or \"text\", not \"%s\"", c.Logging.Format)
+	}
+	if c.Transport.ConnectRetries < 0 {
+		c.errorf(&errs, "transport.connect_retries", "connect_retries must not be negative")
+	}
+	if len(c.Rooms) == 0 {
+		c.errorf(&errs, "rooms", "no rooms configured")
+	}
+	rooms := make(map[string]empty)
+	dbs := make(map[string]empty)
+	for i, rc := range c.Rooms {
+		path := fmt.Sprintf("rooms.%d", i)
+		if rc.Room == "" {
+			c.errorf(&errs, path, "room name is required")
+		} else if _, ok := rooms[rc.Room]; ok {
+			c.errorf(&errs, path+".room", "room \"%s\" is configured more than once", rc.Room)
+		}
+		rooms[rc.Room] = empty{}
+		if _, ok := dbs[rc.DBPath]; ok && rc.DBPath != "" {
+			c.errorf(&errs, path+".db", "db \"%s\" is used by more than one room", rc.DBPath)
+		}
+		dbs[rc.DBPath] = empty{}
+		handlers := make(map[string]empty)
+		for j, name := range rc.Handlers {
+			if _, ok := handlerRegistry[name]; !ok {
+				c.errorf(&errs, fmt.Sprintf("%s.handlers.%d", path, j), "unknown handler \"%s\"", name)
+			} else if _, ok := handlers[name]; ok {
+				c.errorf(&errs, fmt.Sprintf("%s.handlers.%d", path, j), "handler \"%s\" is given more than once", name)
+			}
+			handlers[name] = empty{}
+		}
+		for j, name := range rc.PMHandlers {
+			if _, ok := handlerRegistry[name]; !ok {
+				c.errorf(&errs, fmt.Sprintf("%s.pm_handlers.%d", path, j), "unknown handler \"%s\"", name)
+			}
+		}
+		for name := range rc.HandlerOptions {
+			if _, ok := handlerRegistry[name]; !ok {
+				c.errorf(&errs, path+".handler_options."+name, "options given for unknown handler \"%s\"", name)
+			}
+		}
+		if rc.MsgLogMaxCount < 0 {
+			c.errorf(&errs, path+".msglog_max_count", "msglog_max_count must not be negative")
+		}
+		if rc.AccountPassword != "" && rc.Email == "" {
+			c.errorf(&errs, path+".account_password", "account_password given without email")
+		}
+		if rc.MaxPMs < 0 {
+			c.errorf(&errs, path+".max_pms", "max_pms must not be negative")
+		}
+		if rc.HandlerCrashLimit < 0 {
+			c.errorf(&errs, path+".handler_crash_limit", "handler_crash_limit must not be negative")
+		}
+		for j, pattern := range rc.Ignore {
+			if !validNickPattern(pattern) {
+				c.errorf(&errs, fmt.Sprintf("%s.ignore.%d", path, j), "bad nick pattern \"%s\"", pattern)
+			}
+		}
+		if rc.LoopLimit < 0 {
+			c.errorf(&errs, path+".loop_limit", "loop_limit must not be negative")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// SetDefaults fills in default values for everything left unset in the config.
+func (c *Config) SetDefaults() {
+	if c.Logging.Path == "" {
+		c.Logging.Path = defaultLogPath
+	}
+	if c.Logging.Level == "" {
+		c.Logging.Level = defaultLogLevel
+	}
+	if c.Logging.Format == "" {
+		c.Logging.Format = "json"
+	}
+	if c.Transport.Host == "" {
+		c.Transport.Host = defaultHost
+	}
+	if c.Transport.ConnectRetries == 0 {
+		c.Transport.ConnectRetries = defaultConnectRetries
+	}
+	if c.Transport.RetryDelay.Duration == 0 {
+		c.Transport.RetryDelay.Duration = defaultRetryDelay
+	}
+	for i := range c.Rooms {
+		rc := &c.Rooms[i]
+		if rc.Nick == "" {
+			rc.Nick = defaultNick
+		}
+		if rc.DBPath == "" {
+			rc.DBPath = fmt.Sprintf("room_%s.db", rc.Room)
+		}
+		if rc.CookiePath == "" {
+			rc.CookiePath = fmt.Sprintf("room_%s.cookies", rc.Room)
+		}
+	}
+}
+
+// lineAt returns the line of the first token at or after offset in data.
+func lineAt(data []byte, offset int64) int {
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n:,", data[offset]) >= 0 {
+		offset++
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return 1 + bytes.Count(data[:offset], []byte("\n"))
+}
+
+// jsonValue is a value in a JSON document, found by jsonValues.
+type jsonValue struct {
+	// path is the value's path, in the form used by json.UnmarshalTypeError
+	// ("rooms.0.nick"), and line the line it is on, or its key is on.
+	path string
+	line int
+	// tok is the value if it is a scalar, and its opening json.Delim if not.
+	tok json.Token
+}
+
+// jsonValues returns every value in a JSON document except the document
+// itself, in the order they appear. It returns what it could find if data is
+// invalid.
+func jsonValues(data []byte) []jsonValue {
+	var values []jsonValue
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string, line int) error
+	walk = func(path string, line int) error {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			if line == 0 {
+				line = lineAt(data, offset)
+			}
+			values = append(values, jsonValue{path, line, tok})
+		}
+		prefix := path
+		if prefix != "" {
+			prefix += "."
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				offset := dec.InputOffset()
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				if err := walk(prefix+fmt.Sprint(key), lineAt(data, offset)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(prefix+strconv.Itoa(i), 0); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	walk("", 0)
+	return values
+}
+
+// jsonLines maps the path of every value in values to the line it is on.
+func jsonLines(values []jsonValue) map[string]int {
+	lines := make(map[string]int)
+	for _, v := range values {
+		if _, ok := lines[v.path]; !ok {
+			lines[v.path] = v.line
+		}
+	}
+	return lines
+}
+
+var (
+	durationType   = reflect.TypeOf(Duration{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// configType returns the type of the value at path in a Config, or nil if a
+// Config has no such value. Values within a json.RawMessage are its type.
+func configType(path string) reflect.Type {
+	t := reflect.TypeOf(Config{})
+	for _, name := range strings.Split(path, ".") {
+		switch {
+		case t == rawMessageType:
+			return t
+		case t.Kind() == reflect.Struct:
+			var field *reflect.StructField
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				tag := strings.Split(f.Tag.Get("json"), ",")[0]
+				if f.PkgPath == "" && tag != "" && strings.EqualFold(tag, name) {
+					field = &f
+					break
+				}
+			}
+			if field == nil {
+				return nil
+			}
+			t = field.Type
+		case t.Kind() == reflect.Slice || t.Kind() == reflect.Map:
+			t = t.Elem()
+		default:
+			return nil
+		}
+	}
+	return t
+}
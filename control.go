@@ -0,0 +1,65 @@
+package maimai
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ControlType is the type of a control message sent to a running handler.
+type ControlType string
+
+// Types of control message.
+const (
+	// ControlStop asks the handler to return. It is acknowledged once the
+	// handler has finished with its last packet.
+	ControlStop ControlType = "stop"
+	// ControlPause asks the handler to ignore packets until resumed.
+	ControlPause  ControlType = "pause"
+	ControlResume ControlType = "resume"
+	// ControlReconfigure gives the handler its new options.
+	ControlReconfigure ControlType = "reconfigure"
+	// ControlFlush asks the handler to finish any work it has buffered.
+	ControlFlush ControlType = "flush"
+)
+
+// controlAckTimeout is how long the dispatcher waits for a handler to accept
+// and acknowledge a control message.
+const controlAckTimeout = 5 * time.Second
+
+// Control is a message from the dispatcher to a running handler's loop, which
+// must call Ack exactly once for every Control it receives.
+type Control struct {
+	Type ControlType
+	// Options holds the handler's new options for ControlReconfigure, and is
+	// nil if it has none.
+	Options json.RawMessage
+
+	ack chan empty
+}
+
+// Ack tells the room the handler has acted on the control message.
+func (c *Control) Ack() {
+	if c.ack != nil {
+		close(c.ack)
+	}
+}
+
+// sendControl sends c to a running handler and waits for it to be
+// acknowledged, returning false if it is not in time.
+func (r *Room) sendControl(rh *runningHandler, c *Control) bool {
+	c.ack = make(chan empty)
+	timeout := time.After(controlAckTimeout)
+	select {
+	case rh.control <- c:
+	case <-timeout:
+		r.Logger.Warningf("Handler %s did not accept %s control message.", rh.name, c.Type)
+		return false
+	}
+	select {
+	case <-c.ack:
+		return true
+	case <-timeout:
+		r.Logger.Warningf("Handler %s did not acknowledge %s control message.", rh.name, c.Type)
+		return false
+	}
+}
@@ -0,0 +1,100 @@
+package maimai
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CookieFile keeps the cookies euphoria sets when connecting in a file, so
+// that the bot reconnects as the same agent after restarting and stays logged
+// in. It may be shared by rooms on the same host.
+type CookieFile struct {
+	Path string
+
+	mu      sync.Mutex
+	cookies []*http.Cookie
+}
+
+// LoadCookieFile reads the cookies saved at path. A missing file holds no
+// cookies.
+func LoadCookieFile(path string) (*CookieFile, error) {
+	cf := &CookieFile{Path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &cf.cookies); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+// Header returns a header sending the saved cookies that have not expired.
+func (cf *CookieFile) Header() http.Header {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	var pairs []string
+	now := time.Now()
+	for _, c := range cf.cookies {
+		if c.Expires.IsZero() || c.Expires.After(now) {
+			pairs = append(pairs, (&http.Cookie{Name: c.Name, Value: c.Value}).String())
+		}
+	}
+	header := http.Header{}
+	if len(pairs) > 0 {
+		header.Set("Cookie", strings.Join(pairs, "; "))
+	}
+	return header
+}
+
+// Update saves the cookies set by a response, replacing saved cookies of the
+// same name and removing those the response deletes.
+func (cf *CookieFile) Update(cookies []*http.Cookie) error {
+	if len(cookies) == 0 {
+		return nil
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	for _, c := range cookies {
+		kept := cf.cookies[:0]
+		for _, old := range cf.cookies {
+			if old.Name != c.Name {
+				kept = append(kept, old)
+			}
+		}
+		cf.cookies = kept
+		if c.MaxAge >= 0 {
+			if c.MaxAge > 0 {
+				c.Expires = time.Now().Add(time.Duration(c.MaxAge) * time.Second)
+			}
+			cf.cookies = append(cf.cookies, c)
+		}
+	}
+	data, err := json.MarshalIndent(cf.cookies, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a crash cannot lose the cookies.
+	tmp, err := ioutil.TempFile(filepath.Dir(cf.Path), filepath.Base(cf.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cf.Path)
+}
@@ -0,0 +1,131 @@
+package maimai
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// editMessageCount is how many of the messages the bot edited most recently
+// have the ID of their latest edit remembered, to edit them again.
+const editMessageCount = 100
+
+// maxPendingReplies is how many SendTextLater replies may be waiting for their
+// text at once.
+const maxPendingReplies = 16
+
+// SendTextWait sends a message to the room as SendText does, waiting for the
+// server's reply and returning the message sent, whose ID EditMessage and
+// DeleteMessage take. Like them, it must not be called from a handler's loop.
+func (r *Room) SendTextWait(text string, parent string) (*Message, error) {
+	payload := SendCommand{
+		Content: text,
+		Parent:  parent}
+	reply, err := r.sendCommand(payload, SendType)
+	if err != nil {
+		return nil, err
+	}
+	return GetMessagePayload(reply)
+}
+
+// EditMessage changes the content of a message the bot sent, returning the
+// message as edited.
+func (r *Room) EditMessage(id string, content string) (*Message, error) {
+	reply, err := r.editMessage(EditMessageCommand{ID: id, Content: content, Announce: true})
+	if err != nil {
+		return nil, err
+	}
+	return &reply.Message, nil
+}
+
+// DeleteMessage deletes a message the bot sent.
+func (r *Room) DeleteMessage(id string) error {
+	_, err := r.editMessage(EditMessageCommand{ID: id, Delete: true, Announce: true})
+	if err == nil {
+		r.data.Lock()
+		delete(r.data.editIDs, id)
+		r.data.Unlock()
+	}
+	return err
+}
+
+// editMessage sends an edit-message command, filling in the ID of the
+// message's latest edit, and records the ID of the new one.
+func (r *Room) editMessage(cmd EditMessageCommand) (*EditMessageReply, error) {
+	r.data.Lock()
+	cmd.PreviousEditID = r.data.editIDs[cmd.ID]
+	r.data.Unlock()
+	packet, err := r.sendCommand(cmd, EditMessageType)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := GetEditMessageReplyPayload(packet)
+	if err != nil {
+		return nil, err
+	}
+	r.data.Lock()
+	if _, ok := r.data.editIDs[cmd.ID]; !ok {
+		r.data.edited = append(r.data.edited, cmd.ID)
+		if len(r.data.edited) > editMessageCount {
+			delete(r.data.editIDs, r.data.edited[0])
+			r.data.edited = r.data.edited[1:]
+		}
+	}
+	r.data.editIDs[cmd.ID] = reply.EditID
+	r.data.Unlock()
+	return reply, nil
+}
+
+// SendTextLater replies to the message with the given ID with the text
+// returned by fetch, which is called in a new goroutine with a context that is
+// cancelled when the room is stopped. If fetch takes longer than delay, the
+// placeholder is sent meanwhile and edited once fetch returns, or deleted if it
+// returns no text. An error is returned, without calling fetch, if
+// maxPendingReplies replies are already waiting for theirs.
+func (r *Room) SendTextLater(parent string, placeholder string, delay time.Duration, fetch func(ctx context.Context) string) error {
+	select {
+	case r.pending <- empty{}:
+	default:
+		return errors.New("Too many replies pending.")
+	}
+	done := make(chan string, 1)
+	go func() {
+		done <- fetch(r.ctx)
+	}()
+	go func() {
+		defer func() { <-r.pending }()
+		var text string
+		select {
+		case text = <-done:
+			if text != "" {
+				r.SendText(text, parent)
+			}
+			return
+		case <-time.After(delay):
+		case <-r.stopChan:
+			return
+		}
+		msg, err := r.SendTextWait(placeholder, parent)
+		select {
+		case text = <-done:
+		case <-r.stopChan:
+			return
+		}
+		if err != nil {
+			r.Logger.Errorf("Error sending placeholder: %s", err)
+			if text != "" {
+				r.SendText(text, parent)
+			}
+			return
+		}
+		if text != "" {
+			_, err = r.EditMessage(msg.ID, text)
+		} else {
+			err = r.DeleteMessage(msg.ID)
+		}
+		if err != nil {
+			r.Logger.Errorf("Error replacing placeholder %s: %s", msg.ID, err)
+		}
+	}()
+	return nil
+}
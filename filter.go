@@ -0,0 +1,140 @@
+package maimai
+
+import (
+	"path"
+	"sync"
+	"time"
+)
+
+// Defaults for RoomConfig.LoopLimit and LoopWindow.
+const (
+	defaultLoopLimit  = 5
+	defaultLoopWindow = 10 * time.Second
+)
+
+// ownMessageCount is how many of the bot's most recent messages are
+// remembered, to recognize replies to them.
+const ownMessageCount = 100
+
+// messageFilter marks the inbound messages handlers should not respond to.
+type messageFilter struct {
+	sync.Mutex
+	// own holds the IDs of the bot's recent messages, oldest first.
+	own []string
+	// replies holds, by sender ID, when each sender recently replied to one
+	// of the bot's messages, and throttled the senders being ignored for it.
+	replies   map[string][]time.Time
+	throttled map[string]empty
+}
+
+func newMessageFilter() *messageFilter {
+	return &messageFilter{
+		replies:   make(map[string][]time.Time),
+		throttled: make(map[string]empty),
+	}
+}
+
+func (f *messageFilter) isOwn(msgID string) bool {
+	for _, id := range f.own {
+		if id == msgID {
+			return true
+		}
+	}
+	return false
+}
+
+// validNickPattern returns true if pattern can be used in RoomConfig.Ignore.
+func validNickPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+// isIgnoredUser returns true if the room's Ignore list matches user.
+func (r *Room) isIgnoredUser(user User) bool {
+	nick := normalizeNick(user.Name)
+	for _, pattern := range r.roomConfig().Ignore {
+		if pattern == user.ID {
+			return true
+		}
+		if ok, _ := path.Match(normalizeNick(pattern), nick); ok && nick != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMessage is called by the dispatcher with each inbound packet,
+// remembering the bot's messages and marking messages to be Ignored.
+func (r *Room) filterMessage(packet *PacketEvent) {
+	f := r.filter
+	switch packet.Type {
+	case SendReplyType:
+		if packet.Error != "" {
+			return
+		}
+		data, err := GetMessagePayload(packet)
+		if err != nil {
+			return
+		}
+		f.Lock()
+		f.own = append(f.own, data.ID)
+		if len(f.own) > ownMessageCount {
+			f.own = f.own[len(f.own)-ownMessageCount:]
+		}
+		f.Unlock()
+	case SendEventType:
+		data, err := GetMessagePayload(packet)
+		if err != nil {
+			return
+		}
+		packet.senderSession = senderSessionID(packet)
+		packet.ignored = r.isSelf(packet.senderSession, data.Sender) ||
+			r.isIgnoredUser(data.Sender) || r.isLooping(data)
+	}
+}
+
+// isLooping records replies to the bot's messages, returning true while their
+// sender replies more than the room's LoopLimit times within its LoopWindow.
+func (r *Room) isLooping(msg *Message) bool {
+	cfg := r.roomConfig()
+	limit := cfg.LoopLimit
+	if limit == 0 {
+		limit = defaultLoopLimit
+	}
+	window := cfg.LoopWindow
+	if window == 0 {
+		window = defaultLoopWindow
+	}
+	f := r.filter
+	f.Lock()
+	defer f.Unlock()
+	sender := msg.Sender.ID
+	now := time.Now()
+	var recent []time.Time
+	for _, t := range f.replies[sender] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	if msg.Parent != "" && f.isOwn(msg.Parent) {
+		recent = append(recent, now)
+	}
+	if len(recent) == 0 {
+		delete(f.replies, sender)
+	} else {
+		f.replies[sender] = recent
+	}
+	if len(recent) <= limit {
+		if _, ok := f.throttled[sender]; ok {
+			delete(f.throttled, sender)
+			r.Logger.Infof("No longer ignoring %s (%s).", msg.Sender.Name, sender)
+		}
+		return false
+	}
+	if _, ok := f.throttled[sender]; !ok {
+		f.throttled[sender] = empty{}
+		r.Logger.Warningf("Ignoring %s (%s), which replied to the bot %d times in %s.",
+			msg.Sender.Name, sender, len(recent), window)
+	}
+	return true
+}
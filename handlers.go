@@ -1,11 +1,11 @@
 package maimai
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
@@ -13,11 +13,23 @@ import (
 )
 
 type MsgLogEvent struct {
-	Parent   string `json:"id"`
-	UserID   string `json:"userID"`
-	UserName string `json:"userName"`
-	Time     int64  `json:"time"`
-	Content  string `json:"content"`
+	Parent   string          `json:"id"`
+	UserID   string          `json:"userID"`
+	UserName string          `json:"userName"`
+	Time     int64           `json:"time"`
+	Content  string          `json:"content"`
+	Deleted  int64           `json:"deleted,omitempty"`
+	Versions []MsgLogVersion `json:"versions,omitempty"`
+}
+
+// MsgLogVersion is one version of a logged message's content. Versions are
+// only recorded once a message is edited, the first being the original.
+type MsgLogVersion struct {
+	EditID     string `json:"editID,omitempty"`
+	Time       int64  `json:"time"`
+	EditorID   string `json:"editorID"`
+	EditorName string `json:"editorName"`
+	Content    string `json:"content"`
 }
 
 func prepareMsgLogEvent(msg *Message) (string, *MsgLogEvent) {
@@ -26,15 +38,93 @@ func prepareMsgLogEvent(msg *Message) (string, *MsgLogEvent) {
 		UserID:   msg.Sender.ID,
 		UserName: msg.Sender.Name,
 		Time:     msg.Time,
-		Content:  msg.Content}
+		Content:  msg.Content,
+		Deleted:  int64(msg.Deleted)}
 	return msg.ID, msgLogEvent
 }
 
+// mergeMsgLogEvent carries the edit history and deletion time of a previously
+// logged copy of a message over to a newly received copy, so that logging a
+// message again (e.g. when backfilling) does not lose them.
+func mergeMsgLogEvent(prev *MsgLogEvent, msg *MsgLogEvent) {
+	msg.Versions = prev.Versions
+	if msg.Deleted == 0 {
+		msg.Deleted = prev.Deleted
+	}
+}
+
+// applyMsgLogEdit returns the log entry for a message after the given edit,
+// appending a version if the content changed. prev may be nil if the original
+// message was never logged. The server does not report who made an edit, so
+// the editor recorded is the message's sender as given in the edit event.
+func applyMsgLogEdit(prev *MsgLogEvent, edit *EditMessageEvent) *MsgLogEvent {
+	_, msgLogEvent := prepareMsgLogEvent(&edit.Message)
+	editTime := int64(edit.Edited)
+	if editTime == 0 {
+		editTime = int64(edit.Deleted)
+	}
+	if editTime == 0 {
+		editTime = time.Now().Unix()
+	}
+	if prev != nil {
+		msgLogEvent.Versions = prev.Versions
+		if len(msgLogEvent.Versions) == 0 {
+			msgLogEvent.Versions = append(msgLogEvent.Versions, MsgLogVersion{
+				Time:       prev.Time,
+				EditorID:   prev.UserID,
+				EditorName: prev.UserName,
+				Content:    prev.Content})
+		}
+	}
+	n := len(msgLogEvent.Versions)
+	if n == 0 || msgLogEvent.Versions[n-1].Content != edit.Content {
+		msgLogEvent.Versions = append(msgLogEvent.Versions, MsgLogVersion{
+			EditID:     edit.EditID,
+			Time:       editTime,
+			EditorID:   edit.Sender.ID,
+			EditorName: edit.Sender.Name,
+			Content:    edit.Content})
+	}
+	return msgLogEvent
+}
+
 var linkMatcher = regexp.MustCompile("(https?://)?[\\S]+\\.[\\S][\\S]+[\\S^\\.]")
 
-// Handler describes functions that process packets.
+// Handler describes functions that process packets in their own loop,
+// stopping when sent "kill" on cmdChan. New handlers should implement
+// PacketHandler instead, leaving the loop to the room.
 type Handler func(room *Room, input chan PacketEvent, cmdChan chan string)
 
+// handlerRegistry maps the names handlers are enabled by in RoomConfig.Handlers
+// to the handlers.
+var handlerRegistry = map[string]HandlerFactory{
+	"ping-event":      Handler(PingEventHandler),
+	"ping-command":    MessageHandler(PingCommandHandler),
+	"bot-commands":    MessageHandler(BotCommandHandler),
+	"seen-command":    MessageHandler(SeenCommandHandler),
+	"seen-record":     RecordingHandler(Handler(SeenRecordHandler)),
+	"log-backfill":    Handler(LogBackfillHandler),
+	"link-title":      Handler(LinkTitleHandler),
+	"uptime-command":  MessageHandler(UptimeCommandHandler),
+	"scritch-command": MessageHandler(ScritchCommandHandler),
+	"debug":           RecordingHandler(Handler(DebugHandler)),
+	"nick-change":     Handler(NickChangeHandler),
+	"join-event":      Handler(JoinEventHandler),
+	"part-event":      HandlerFactoryFunc(func() PacketHandler { return &PartEventHandler{} }),
+	"message-log":     RecordingHandler(Handler(MessageLogHandler)),
+	"history-command": MessageHandler(HistoryCommandHandler),
+	"login":           HandlerFactoryFunc(func() PacketHandler { return &LoginHandler{} }),
+	"auth":            HandlerFactoryFunc(func() PacketHandler { return &AuthHandler{} }),
+	"pm":              HandlerFactoryFunc(func() PacketHandler { return &PMHandler{} }),
+}
+
+// RegisterHandler makes h available to be enabled by name in a RoomConfig or
+// config file. It should be called from an init function, before any rooms
+// are created or configs loaded.
+func RegisterHandler(name string, h HandlerFactory) {
+	handlerRegistry[name] = h
+}
+
 // PingEventHandler processes a ping-event and replies with a ping-reply.
 func PingEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	for {
@@ -43,15 +133,9 @@ func PingEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 			if packet.Type != PingEventType {
 				continue
 			}
-			payload, err := packet.Payload()
-			if err != nil {
-				room.errChan <- err
-				return
-			}
-			data, ok := payload.(*PingEvent)
-			if !ok {
-				room.errChan <- errors.New("Could not assert payload as *PingEvent.")
-				return
+			data := handlerPayload[PingEvent](room, &packet)
+			if data == nil {
+				continue
 			}
 			room.sendPing(data.Time)
 		case cmd := <-cmdChan:
@@ -62,94 +146,120 @@ func PingEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	}
 }
 
-func isValidPingCommand(payload *Message) bool {
-	if len(payload.Content) >= 5 && payload.Content[0:5] == "!ping" {
-		return true
+// isBotCommand returns true if mc gives the named command to the bot in
+// particular, as "!name @MaiMai" or addressed to it as "@MaiMai name".
+func isBotCommand(mc *MessageContext, name string) bool {
+	if mc.Command != name {
+		return false
 	}
-	return false
+	if mc.Addressed {
+		return len(mc.Args) == 0
+	}
+	if len(mc.Args) != 1 {
+		return false
+	}
+	nick, ok := parseMention(mc.Args[0])
+	return ok && mc.Room.isSelfNick(nick)
 }
 
-// PingCommandHandler handles a send-event, checks for a !ping, and replies.
-func PingCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
-	for {
-		select {
-		case packet := <-input:
-			if packet.Type != SendEventType {
-				continue
-			}
-			data := GetMessagePayload(&packet)
-			if isValidPingCommand(data) {
-				room.SendText("pong!", data.ID)
-			}
-		case cmd := <-cmdChan:
-			if cmd == "kill" {
-				return
-			}
-		}
-	}
+func isValidPingCommand(mc *MessageContext) bool {
+	return (mc.Command == "ping" && len(mc.Args) == 0 && !mc.Addressed) ||
+		isBotCommand(mc, "ping")
 }
 
-// SeenRecordHandler handles a send-event and records that the sender was seen.
-func SeenRecordHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
-	for {
-		select {
-		case packet := <-input:
-			if packet.Type != SendEventType {
-				continue
-			}
-			data := GetMessagePayload(&packet)
-			user := strings.Replace(data.Sender.Name, " ", "", -1)
-			t := time.Now().Unix()
-			err := room.storeSeen(user, t)
-			if err != nil {
-				room.errChan <- err
-				return
-			}
-		case cmd := <-cmdChan:
-			if cmd == "kill" {
-				return
-			}
-		}
+// PingCommandHandler replies to !ping, given to every bot in the room or to
+// this one.
+func PingCommandHandler(mc *MessageContext) error {
+	if isValidPingCommand(mc) {
+		mc.ReplyThreaded("pong!")
 	}
+	return nil
 }
 
-func isValidSeenCommand(payload *Message) bool {
-	if len(payload.Content) >= 5 &&
-		payload.Content[0:5] == "!seen" &&
-		string(payload.Content[6]) == "@" &&
-		len(strings.Split(payload.Content, " ")) == 2 {
-		return true
+// defaultBotHelp is the bot-commands handler's reply to !help, unless its
+// "help" option is set.
+const defaultBotHelp = "I am a bot run with maimai. Follow !kill or " +
+	"!restart with a mention of me to disconnect or reconnect me."
+
+// BotCommandHandler implements euphoria's conventions for bots: it replies to
+// "!ping" and "!ping @MaiMai" with "pong!", and to "!help @MaiMai" with the
+// text of its "help" option. "!kill @MaiMai" stops the room and "!restart
+// @MaiMai" reconnects to it with a new session.
+func BotCommandHandler(mc *MessageContext) error {
+	switch {
+	case isValidPingCommand(mc):
+		mc.ReplyThreaded("pong!")
+	case isBotCommand(mc, "help"):
+		opts := struct {
+			Help string `json:"help"`
+		}{defaultBotHelp}
+		if _, err := mc.Room.HandlerOptions("bot-commands", &opts); err != nil {
+			return err
+		}
+		mc.ReplyThreaded(opts.Help)
+	case isBotCommand(mc, "kill"):
+		mc.Room.Logger.Warningf("Killed by %s (%s).", mc.Sender().Name, mc.Sender().ID)
+		// Stopping the room waits for this handler to return, so the reply is
+		// sent and the room stopped in another goroutine.
+		go func(msgID string) {
+			if _, err := mc.Room.SendTextWait("/me is exiting.", msgID); err != nil {
+				mc.Room.Logger.Errorf("Error replying to !kill: %s", err)
+			}
+			mc.Room.Stop()
+		}(mc.Message.ID)
+	case isBotCommand(mc, "restart"):
+		mc.Room.Logger.Warningf("Restarted by %s (%s).", mc.Sender().Name, mc.Sender().ID)
+		go func(msgID string) {
+			if _, err := mc.Room.SendTextWait("/me is restarting.", msgID); err != nil {
+				mc.Room.Logger.Errorf("Error replying to !restart: %s", err)
+			}
+			// The sender receiver reconnects on its own goroutine; there is
+			// nothing to reconnect once the room has been stopped.
+			if !mc.Room.Stopped() {
+				mc.Room.sr.reconnect()
+			}
+		}(mc.Message.ID)
 	}
-	return false
+	return nil
 }
 
-// SeenCommandHandler handles a send-event, checks if !seen command was given, and responds.
-// TODO : make seen record a time when a user joins a room or changes their nick
-func SeenCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+// SeenRecordHandler handles a send-event and records that the sender was seen.
+// Messages received from a log-reply are recorded at the time they were sent.
+func SeenRecordHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	for {
 		select {
 		case packet := <-input:
-			if packet.Type != SendEventType {
+			if packet.Type != SendEventType && packet.Type != LogReplyType {
 				continue
 			}
-			data := GetMessagePayload(&packet)
-			if isValidSeenCommand(data) {
-				trimmed := strings.TrimSpace(data.Content)
-				splits := strings.Split(trimmed, " ")
-				lastSeen, err := room.retrieveSeen(splits[1][1:])
-				if err != nil {
+			switch packet.Type {
+			case SendEventType:
+				data := handlerPayload[Message](room, &packet)
+				if data == nil {
+					continue
+				}
+				user := strings.Replace(data.Sender.Name, " ", "", -1)
+				t := time.Now().Unix()
+				if err := room.store.StoreSeen(user, t); err != nil {
 					room.errChan <- err
 					return
 				}
-				if lastSeen == nil {
-					room.SendText("User has not been seen yet.", data.ID)
+			case LogReplyType:
+				data := handlerPayload[LogReply](room, &packet)
+				if data == nil {
 					continue
 				}
-				lastSeenInt, _ := strconv.Atoi(string(lastSeen))
-				lastSeenTime := time.Unix(int64(lastSeenInt), 0)
-				since := time.Since(lastSeenTime)
-				room.SendText(fmt.Sprintf("Seen %v hours ago.",
-					int(since.Hours())), data.ID)
+				times := make(map[string]int64)
+				for _, msg := range data.Log {
+					user := strings.Replace(msg.Sender.Name, " ", "", -1)
+					if msg.Time > times[user] {
+						times[user] = msg.Time
+					}
+				}
+				if err := room.store.StoreSeenTimes(times); err != nil {
+					room.errChan <- err
+					return
+				}
 			}
 		case cmd := <-cmdChan:
 			if cmd == "kill" {
@@ -159,6 +269,32 @@ func SeenCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string)
 	}
 }
 
+func isValidSeenCommand(mc *MessageContext) bool {
+	return mc.Command == "seen" && len(mc.Args) == 1 &&
+		len(mc.Args[0]) > 1 && mc.Args[0][0] == '@'
+}
+
+// SeenCommandHandler checks if a seen command was given, as "!seen @nick" or
+// "@MaiMai seen @nick", and responds.
+// TODO : make seen record a time when a user joins a room or changes their nick
+func SeenCommandHandler(mc *MessageContext) error {
+	if !isValidSeenCommand(mc) {
+		return nil
+	}
+	lastSeen, ok, err := mc.Room.store.RetrieveSeen(mc.Args[0][1:])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		mc.ReplyThreaded("User has not been seen yet.")
+		return nil
+	}
+	lastSeenTime := time.Unix(lastSeen, 0)
+	since := time.Since(lastSeenTime)
+	mc.ReplyThreaded(fmt.Sprintf("Seen %v hours ago.", int(since.Hours())))
+	return nil
+}
+
 func extractTitleFromTree(z *html.Tokenizer) string {
 	depth := 0
 	for {
@@ -183,8 +319,12 @@ func extractTitleFromTree(z *html.Tokenizer) string {
 	}
 }
 
-func getLinkTitle(url string) (string, error) {
-	resp, err := http.Get(url)
+func getLinkTitle(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -196,26 +336,49 @@ func getLinkTitle(url string) (string, error) {
 	return extractTitleFromTree(z), nil
 }
 
+// defaultLinkTitleDelay is how long LinkTitleHandler waits for a title before
+// posting a placeholder, unless its "placeholder_delay" option is set.
+const defaultLinkTitleDelay = time.Second
+
 // LinkTitleHandler handles a send-event, looks for URLs, and replies with the
-// title text of a link if a valid one is found.
+// title text of a link if a valid one is found. Titles that are slow to fetch
+// are replied with a placeholder, which is edited once the title is found.
 func LinkTitleHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	opts := struct {
+		PlaceholderDelay Duration `json:"placeholder_delay"`
+	}{Duration{defaultLinkTitleDelay}}
+	if _, err := room.HandlerOptions("link-title", &opts); err != nil {
+		room.Logger.Errorf("Invalid link-title options, using defaults: %s", err)
+		opts.PlaceholderDelay.Duration = defaultLinkTitleDelay
+	}
 	for {
 		select {
 		case packet := <-input:
 			if packet.Type != SendEventType {
 				continue
 			}
-			data := GetMessagePayload(&packet)
+			data := handlerPayload[Message](room, &packet)
+			if data == nil {
+				continue
+			}
 			urls := linkMatcher.FindAllString(data.Content, -1)
-			for _, url := range urls {
-				if !strings.HasPrefix(url, "http") {
-					url = "http://" + url
-				}
-				title, err := getLinkTitle(url)
-				if err == nil && title != "" {
-					room.SendText("Link title: "+title, data.ID)
-					break
+			if len(urls) == 0 {
+				continue
+			}
+			err := room.SendTextLater(data.ID, "Fetching link title...", opts.PlaceholderDelay.Duration, func(ctx context.Context) string {
+				for _, url := range urls {
+					if !strings.HasPrefix(url, "http") {
+						url = "http://" + url
+					}
+					title, err := getLinkTitle(ctx, url)
+					if err == nil && title != "" {
+						return "Link title: " + title
+					}
 				}
+				return ""
+			})
+			if err != nil {
+				room.Logger.Warningf("Not fetching link titles: %s", err)
 			}
 		case cmd := <-cmdChan:
 			if cmd == "kill" {
@@ -225,49 +388,21 @@ func LinkTitleHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	}
 }
 
-// UptimeCommandHandler handlers a send-event and if the command is given
-// replies with the time since the bot was started.
-func UptimeCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
-	for {
-		select {
-		case packet := <-input:
-			if packet.Type != SendEventType {
-				continue
-			}
-			data := GetMessagePayload(&packet)
-			if data.Content == "!uptime" {
-				since := time.Since(room.uptime)
-				room.SendText(fmt.Sprintf(
-					"This bot has been up for %s.",
-					since.String()),
-					data.ID)
-			}
-		case cmd := <-cmdChan:
-			if cmd == "kill" {
-				return
-			}
-		}
+// UptimeCommandHandler replies to !uptime with the time since the bot was
+// started.
+func UptimeCommandHandler(mc *MessageContext) error {
+	if mc.Command == "uptime" && len(mc.Args) == 0 {
+		since := time.Since(mc.Room.uptime)
+		mc.ReplyThreaded(fmt.Sprintf("This bot has been up for %s.", since.String()))
 	}
+	return nil
 }
 
-func ScritchCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
-	for {
-		select {
-		case packet := <-input:
-			if packet.Type != SendEventType {
-				continue
-			}
-			data := GetMessagePayload(&packet)
-			if data.Content == "!scritch" {
-				room.SendText("/me bruxes",
-					data.ID)
-			}
-		case cmd := <-cmdChan:
-			if cmd == "kill" {
-				return
-			}
-		}
+func ScritchCommandHandler(mc *MessageContext) error {
+	if mc.Command == "scritch" && len(mc.Args) == 0 {
+		mc.ReplyThreaded("/me bruxes")
 	}
+	return nil
 }
 
 func DebugHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
@@ -278,14 +413,10 @@ func DebugHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 				room.Logger.Errorf("Packet received containing error: %s", packet.Error)
 			}
 			if packet.Type == BounceEventType {
-				payload, err := packet.Payload()
+				data, err := GetBounceEventPayload(&packet)
 				if err != nil {
 					continue
 				}
-				data, ok := payload.(*BounceEvent)
-				if !ok {
-					continue
-				}
 				room.Logger.Errorf("BounceEvent received, reason: %s and ID: %s", data.Reason, packet.ID)
 			}
 		case cmd := <-cmdChan:
@@ -303,7 +434,10 @@ func NickChangeHandler(room *Room, input chan PacketEvent, cmdChan chan string)
 			if packet.Type != NickEventType {
 				continue
 			}
-			data := GetNickEventPayload(&packet)
+			data := handlerPayload[NickEvent](room, &packet)
+			if data == nil {
+				continue
+			}
 			// Don't want to process joins or leaves here
 			if data.From == "" || data.To == "" {
 				continue
@@ -317,31 +451,67 @@ func NickChangeHandler(room *Room, input chan PacketEvent, cmdChan chan string)
 	}
 }
 
-func partTimer(room *Room, user string) {
-	time.Sleep(time.Duration(5) * time.Minute)
+// defaultPartDelay is how long PartEventHandler waits for a user to rejoin
+// before announcing that they left, unless its "delay" option is set.
+const defaultPartDelay = 5 * time.Minute
+
+func partTimer(room *Room, user string, delay time.Duration) {
+	time.Sleep(delay)
 	if room.isUserLeaving(user) && user != "" {
 		room.SendText(fmt.Sprintf("< %s left the room. >", user), "")
 		room.clearUserLeaving(user)
 	}
 }
 
-func PartEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
-	for {
-		select {
-		case packet := <-input:
-			if packet.Type != PartEventType {
-				continue
-			}
-			data := GetPresenceEventPayload(&packet)
-			user := data.User.Name
-			room.setUserLeaving(user)
-			go partTimer(room, user)
-		case cmd := <-cmdChan:
-			if cmd == "kill" {
-				return
-			}
-		}
+// PartEventHandler announces users leaving the room, unless they rejoin
+// within the delay given by its "delay" option. Departures seen before it is
+// paused or reconfigured are still announced after the old delay.
+type PartEventHandler struct {
+	room  *Room
+	delay time.Duration
+}
+
+func (h *PartEventHandler) Init(room *Room) error {
+	h.room = room
+	if err := h.Reconfigure(room.roomConfig().HandlerOptions["part-event"]); err != nil {
+		room.Logger.Errorf("Handler part-event: %s", err)
+	}
+	return nil
+}
+
+func (h *PartEventHandler) HandlePacket(ctx context.Context, packet *PacketEvent) error {
+	if packet.Type != PartEventType {
+		return nil
+	}
+	data, err := GetPresenceEventPayload(packet)
+	if err != nil {
+		return err
+	}
+	user := data.User.Name
+	h.room.setUserLeaving(user)
+	go partTimer(h.room, user, h.delay)
+	return nil
+}
+
+func (h *PartEventHandler) Close() error {
+	return nil
+}
+
+// Reconfigure reads the handler's options, using the defaults if they are
+// invalid.
+func (h *PartEventHandler) Reconfigure(options json.RawMessage) error {
+	opts := struct {
+		Delay Duration `json:"delay"`
+	}{Duration{defaultPartDelay}}
+	h.delay = defaultPartDelay
+	if options == nil {
+		return nil
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		return fmt.Errorf("invalid part-event options, using defaults: %s", err)
 	}
+	h.delay = opts.Delay.Duration
+	return nil
 }
 
 func JoinEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
@@ -353,7 +523,10 @@ func JoinEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 			}
 			switch packet.Type {
 			case JoinEventType:
-				data := GetPresenceEventPayload(&packet)
+				data := handlerPayload[PresenceEvent](room, &packet)
+				if data == nil {
+					continue
+				}
 				user := data.User.Name
 				if user == "" {
 					continue
@@ -363,7 +536,10 @@ func JoinEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 				}
 				room.clearUserLeaving(user)
 			case NickEventType:
-				data := GetNickEventPayload(&packet)
+				data := handlerPayload[NickEvent](room, &packet)
+				if data == nil {
+					continue
+				}
 				if data.From != "" {
 					continue
 				}
@@ -380,19 +556,63 @@ func JoinEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	}
 }
 
+// LogBackfillHandler handles a log-reply received while backfilling and
+// requests the next page of history until the newest logged message is reached.
+func LogBackfillHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != LogReplyType {
+				continue
+			}
+			data := handlerPayload[LogReply](room, &packet)
+			if data == nil {
+				continue
+			}
+			if before, ok := room.nextBackfillPage(data); ok {
+				room.SendLog(logPageSize, before)
+			}
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
+
+// MessageLogHandler records messages sent in the room, along with any later
+// edits and deletions, in the message log.
 func MessageLogHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	for {
 		select {
 		case packet := <-input:
 			switch packet.Type {
 			case SendEventType:
-				data := GetMessagePayload(&packet)
+				data := handlerPayload[Message](room, &packet)
+				if data == nil {
+					continue
+				}
 				msgID, msgLogEvent := prepareMsgLogEvent(data)
 				room.storeMsgLogEvent(msgID, msgLogEvent)
 			case SendReplyType:
-				data := GetMessagePayload(&packet)
+				data := handlerPayload[Message](room, &packet)
+				if data == nil {
+					continue
+				}
 				msgID, msgLogEvent := prepareMsgLogEvent(data)
 				room.storeMsgLogEvent(msgID, msgLogEvent)
+			case LogReplyType:
+				data := handlerPayload[LogReply](room, &packet)
+				if data == nil {
+					continue
+				}
+				room.storeMsgLog(data.Log)
+			case EditMessageEventType:
+				data := handlerPayload[EditMessageEvent](room, &packet)
+				if data == nil {
+					continue
+				}
+				room.storeMsgLogEdit(data)
 			}
 		case cmd := <-cmdChan:
 			if cmd == "kill" {
@@ -401,3 +621,273 @@ func MessageLogHandler(room *Room, input chan PacketEvent, cmdChan chan string)
 		}
 	}
 }
+
+func isValidHistoryCommand(mc *MessageContext) bool {
+	return mc.Command == "history" && len(mc.Args) == 1
+}
+
+func formatMsgLogHistory(msgID string, msg *MsgLogEvent) string {
+	var lines []string
+	if len(msg.Versions) == 0 {
+		lines = append(lines, fmt.Sprintf("Message %s has not been edited.", msgID))
+	}
+	for i, v := range msg.Versions {
+		lines = append(lines, fmt.Sprintf("%d. %s by %s: %s", i+1,
+			time.Unix(v.Time, 0).UTC().Format(time.RFC3339), v.EditorName, v.Content))
+	}
+	if msg.Deleted != 0 {
+		lines = append(lines, fmt.Sprintf("Deleted %s.",
+			time.Unix(msg.Deleted, 0).UTC().Format(time.RFC3339)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// HistoryCommandHandler replies to the !history command, if a moderator gave
+// it, with the logged versions of the given message.
+func HistoryCommandHandler(mc *MessageContext) error {
+	if !isValidHistoryCommand(mc) {
+		return nil
+	}
+	sender := mc.Sender()
+	if !sender.IsManager && !sender.IsStaff {
+		mc.ReplyThreaded("Only moderators can view message history.")
+		return nil
+	}
+	msgID := mc.Args[0]
+	msg, err := mc.Room.store.RetrieveMsgLogEvent(msgID)
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		mc.ReplyThreaded(fmt.Sprintf("No record of message %s.", msgID))
+		return nil
+	}
+	mc.ReplyThreaded(formatMsgLogHistory(msgID, msg))
+	return nil
+}
+
+// LoginHandler logs the bot in to the account given by the room's Email and
+// AccountPassword when it connects without being logged in. The server then
+// disconnects, and the bot is logged in once it has reconnected with the
+// same cookie.
+type LoginHandler struct {
+	room *Room
+}
+
+func (h *LoginHandler) Init(room *Room) error {
+	h.room = room
+	return nil
+}
+
+func (h *LoginHandler) HandlePacket(ctx context.Context, packet *PacketEvent) error {
+	switch packet.Type {
+	case HelloEventType:
+		data, err := GetHelloEventPayload(packet)
+		if err != nil {
+			return err
+		}
+		cfg := h.room.roomConfig()
+		if data.Account != nil {
+			h.room.Logger.Infof("Logged in to account %s.", data.Account.Name)
+		} else if cfg.Email != "" {
+			h.room.Logger.Infof("Logging in as %s.", cfg.Email)
+			h.room.SendLogin(cfg.Email, cfg.AccountPassword)
+		}
+	case LoginReplyType:
+		data, err := GetLoginReplyPayload(packet)
+		if err != nil {
+			return err
+		}
+		if !data.Success {
+			return fmt.Errorf("Login failed: %s", data.Reason)
+		}
+		h.room.Logger.Infof("Logged in to account %s, reconnecting.", data.AccountID)
+	}
+	return nil
+}
+
+func (h *LoginHandler) Close() error {
+	return nil
+}
+
+// Defaults for the auth handler's "attempts" and "retry_delay" options.
+const (
+	defaultAuthAttempts   = 3
+	defaultAuthRetryDelay = 5 * time.Second
+)
+
+// AuthError is the error a room is stopped with when it cannot authenticate.
+type AuthError struct {
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("Could not authenticate: %s", e.Reason)
+}
+
+type authState int
+
+const (
+	authNone authState = iota
+	authPending
+	authSucceeded
+	authFailed
+)
+
+// AuthHandler authenticates with the room's password when the server bounces
+// the bot from a private room. A rejected password is sent again after its
+// "retry_delay" option, doubling each time, so that a password corrected by
+// reloading the config is used. Once "attempts" passwords have been rejected,
+// or if the room cannot be entered with a password, the room is stopped with
+// an *AuthError.
+type AuthHandler struct {
+	room     *Room
+	state    authState
+	attempts int
+	retry    *time.Timer
+	opts     struct {
+		Attempts   int      `json:"attempts"`
+		RetryDelay Duration `json:"retry_delay"`
+	}
+}
+
+func (h *AuthHandler) Init(room *Room) error {
+	h.room = room
+	h.opts.Attempts = defaultAuthAttempts
+	h.opts.RetryDelay.Duration = defaultAuthRetryDelay
+	_, err := room.HandlerOptions("auth", &h.opts)
+	if h.opts.Attempts <= 0 {
+		h.opts.Attempts = defaultAuthAttempts
+	}
+	return err
+}
+
+func (h *AuthHandler) HandlePacket(ctx context.Context, packet *PacketEvent) error {
+	switch packet.Type {
+	case HelloEventType:
+		// A new connection, which will be bounced again if it needs auth.
+		h.stopRetry()
+		if h.state != authFailed {
+			h.state = authNone
+		}
+	case BounceEventType:
+		data, err := GetBounceEventPayload(packet)
+		if err != nil {
+			return err
+		}
+		if h.state == authPending || h.state == authFailed {
+			return nil
+		}
+		if !canUsePasscode(data.AuthOptions) {
+			h.fail(fmt.Sprintf("bounced (%s) and passcode auth is not offered", data.Reason))
+			return nil
+		}
+		if h.room.roomConfig().Password == "" {
+			h.fail(fmt.Sprintf("bounced (%s) and no password is configured", data.Reason))
+			return nil
+		}
+		h.sendAuth()
+	case AuthReplyType:
+		data, err := GetAuthReplyPayload(packet)
+		if err != nil {
+			return err
+		}
+		if h.state != authPending {
+			return nil
+		}
+		if data.Success {
+			h.state = authSucceeded
+			h.attempts = 0
+			h.room.Logger.Infoln("Authenticated.")
+			return nil
+		}
+		if h.attempts >= h.opts.Attempts {
+			h.fail(fmt.Sprintf("password rejected %d times: %s", h.attempts, data.Reason))
+			return nil
+		}
+		delay := h.opts.RetryDelay.Duration << uint(h.attempts-1)
+		h.room.Logger.Warningf("Password rejected: %s. Retrying in %s.", data.Reason, delay)
+		h.retry = time.AfterFunc(delay, func() {
+			h.room.SendAuth()
+		})
+		h.attempts++
+	}
+	return nil
+}
+
+func (h *AuthHandler) sendAuth() {
+	h.state = authPending
+	h.attempts++
+	h.room.Logger.Debugln("Sending auth.")
+	h.room.SendAuth()
+}
+
+func (h *AuthHandler) fail(reason string) {
+	h.state = authFailed
+	h.room.reportError(&AuthError{reason})
+}
+
+func (h *AuthHandler) stopRetry() {
+	if h.retry != nil {
+		h.retry.Stop()
+		h.retry = nil
+	}
+}
+
+func (h *AuthHandler) Close() error {
+	h.stopRetry()
+	return nil
+}
+
+// canUsePasscode reports whether a bounce-event's auth options allow passcode
+// auth. The server may give none, in which case a passcode is tried.
+func canUsePasscode(options []string) bool {
+	if len(options) == 0 {
+		return true
+	}
+	for _, option := range options {
+		if option == "passcode" {
+			return true
+		}
+	}
+	return false
+}
+
+// PMHandler opens private message rooms when a user invites the bot to one,
+// and when the server replies to an invitation sent with Room.InitiatePM.
+type PMHandler struct {
+	room *Room
+}
+
+func (h *PMHandler) Init(room *Room) error {
+	h.room = room
+	return nil
+}
+
+func (h *PMHandler) HandlePacket(ctx context.Context, packet *PacketEvent) error {
+	switch packet.Type {
+	case PMInitiateEventType:
+		data, err := GetPMInitiateEventPayload(packet)
+		if err != nil {
+			return err
+		}
+		h.room.Logger.Infof("Invited to PM %s by %s (%s).", data.PMID, data.FromNick, data.From)
+		_, err = h.room.OpenPM(data.PMID)
+		return err
+	case PMInitiateReplyType:
+		if packet.Error != "" {
+			return fmt.Errorf("Could not initiate PM: %s", packet.Error)
+		}
+		data, err := GetPMInitiateReplyPayload(packet)
+		if err != nil {
+			return err
+		}
+		_, err = h.room.OpenPM(data.PMID)
+		return err
+	}
+	return nil
+}
+
+func (h *PMHandler) Close() error {
+	return nil
+}
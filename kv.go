@@ -0,0 +1,99 @@
+package maimai
+
+import "encoding/json"
+
+// handlerBucketPrefix is prepended to a handler's name to form the name of
+// the bucket holding its KV data.
+const handlerBucketPrefix = "Handler:"
+
+// KV is a handler's own namespaced key-value store, kept in a bucket of the
+// room's Store that is created the first time it is written to. Handlers
+// should use it rather than the Store directly so that their data cannot
+// collide with the room's or another handler's.
+type KV struct {
+	store  Store
+	bucket string
+}
+
+// KV returns the key-value store of the handler registered under name.
+func (r *Room) KV(name string) *KV {
+	return &KV{r.store, handlerBucketPrefix + name}
+}
+
+// View runs fn in a read-only transaction on the handler's bucket.
+func (kv *KV) View(fn func(b Bucket) error) error {
+	return kv.store.View(func(tx Tx) error {
+		b, err := tx.Bucket(kv.bucket)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// Update runs fn in a writable transaction on the handler's bucket. Changes
+// made by fn are discarded if it returns an error.
+func (kv *KV) Update(fn func(b Bucket) error) error {
+	return kv.store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(kv.bucket)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// Get returns a copy of the value stored under key, or nil if there is none.
+func (kv *KV) Get(key string) ([]byte, error) {
+	var value []byte
+	err := kv.View(func(b Bucket) error {
+		if v := b.Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Put stores value under key.
+func (kv *KV) Put(key string, value []byte) error {
+	return kv.Update(func(b Bucket) error {
+		return b.Put([]byte(key), value)
+	})
+}
+
+// Delete removes key and its value, if present.
+func (kv *KV) Delete(key string) error {
+	return kv.Update(func(b Bucket) error {
+		return b.Delete([]byte(key))
+	})
+}
+
+// ForEach calls fn with each key and value in key order, stopping at the
+// first error returned. The value must not be used after fn returns.
+func (kv *KV) ForEach(fn func(key string, value []byte) error) error {
+	return kv.View(func(b Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// GetJSON decodes the JSON value stored under key into v, returning false if
+// there is no value.
+func (kv *KV) GetJSON(key string, v interface{}) (bool, error) {
+	data, err := kv.Get(key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// PutJSON stores the JSON encoding of v under key.
+func (kv *KV) PutJSON(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return kv.Put(key, data)
+}
@@ -0,0 +1,321 @@
+package maimai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// PacketHandler is a handler the room runs the loop for, in a goroutine of its
+// own. Init is called when the handler is started, from the dispatcher, or
+// from the handler's goroutine when it is restarted after a crash. From then
+// on HandlePacket is called from that goroutine for every packet the room
+// receives, one at a time, with a context that is cancelled when the room is
+// stopped, and Close from it when the handler is stopped. None of them should
+// block for long. Errors returned by any of them are logged.
+type PacketHandler interface {
+	Init(room *Room) error
+	HandlePacket(ctx context.Context, packet *PacketEvent) error
+	Close() error
+}
+
+// HandlerFactory is what handlers are registered and added to rooms as,
+// creating the PacketHandler run each time the handler is started. It is
+// implemented by Handler, MessageHandler and HandlerFactoryFunc.
+type HandlerFactory interface {
+	NewHandler() PacketHandler
+}
+
+// HandlerFactoryFunc is a function creating PacketHandlers, as a
+// HandlerFactory.
+type HandlerFactoryFunc func() PacketHandler
+
+func (f HandlerFactoryFunc) NewHandler() PacketHandler {
+	return f()
+}
+
+// RecordingHandler returns h marked as recording the messages sent to the room
+// rather than responding to them. Its handlers are passed the messages the
+// room ignores, which other handlers are not; see PacketEvent.Ignored.
+func RecordingHandler(h HandlerFactory) HandlerFactory {
+	return recordingHandler{h}
+}
+
+type recordingHandler struct {
+	HandlerFactory
+}
+
+// Reconfigurer is implemented by PacketHandlers that can apply new options
+// while running. Those that do not keep the options they read in Init.
+type Reconfigurer interface {
+	Reconfigure(options json.RawMessage) error
+}
+
+// Flusher is implemented by PacketHandlers that buffer work, which Flush
+// finishes.
+type Flusher interface {
+	Flush() error
+}
+
+// errHandlerExited is returned by the adapter running a Handler once the
+// function has returned.
+var errHandlerExited = errors.New("Handler has exited.")
+
+// PanicError is the error a panic raised by a handler is reported as. The
+// handler is restarted, up to RoomConfig.HandlerCrashLimit times.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+	// Packet is the packet being handled, or for function handlers the one
+	// most recently passed to the function. It is nil if the panic was not
+	// raised handling a packet.
+	Packet *PacketEvent
+}
+
+func (pe *PanicError) Error() string {
+	if pe.Packet == nil {
+		return fmt.Sprintf("panic: %v", pe.Value)
+	}
+	return fmt.Sprintf("panic handling %s packet %s: %v", pe.Packet.Type, pe.Packet.Data, pe.Value)
+}
+
+// callHandler calls f, one of a handler's methods, returning a *PanicError if
+// it panics.
+func callHandler(packet *PacketEvent, f func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = &PanicError{p, debug.Stack(), packet}
+		}
+	}()
+	return f()
+}
+
+// adapterGoroutine runs the function behind an adapter, recording the packet
+// most recently passed to it and any panic it raises.
+type adapterGoroutine struct {
+	done chan empty
+	mu   sync.Mutex
+	last *PacketEvent
+	err  *PanicError
+}
+
+func (g *adapterGoroutine) start(f func()) {
+	g.done = make(chan empty)
+	g.last = nil
+	g.err = nil
+	go func() {
+		defer close(g.done)
+		defer func() {
+			if p := recover(); p != nil {
+				g.mu.Lock()
+				g.err = &PanicError{p, debug.Stack(), g.last}
+				g.mu.Unlock()
+			}
+		}()
+		f()
+	}()
+}
+
+// pass passes a packet to the function on input.
+func (g *adapterGoroutine) pass(ctx context.Context, input chan PacketEvent, packet *PacketEvent) error {
+	g.mu.Lock()
+	g.last = packet
+	g.mu.Unlock()
+	select {
+	case input <- *packet:
+		return nil
+	case <-g.done:
+		return g.exitErr()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// exitErr returns why the function returned, once done is closed.
+func (g *adapterGoroutine) exitErr() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err != nil {
+		return g.err
+	}
+	return errHandlerExited
+}
+
+// handlerAdapter is a PacketHandler running a Handler in its own goroutine.
+// Reconfiguring it restarts the Handler so that it reads its new options.
+type handlerAdapter struct {
+	adapterGoroutine
+	h       Handler
+	room    *Room
+	input   chan PacketEvent
+	cmdChan chan string
+}
+
+// NewHandler returns a PacketHandler running h in its own goroutine.
+func (h Handler) NewHandler() PacketHandler {
+	return &handlerAdapter{h: h}
+}
+
+func (a *handlerAdapter) Init(room *Room) error {
+	a.room = room
+	a.input = make(chan PacketEvent)
+	a.cmdChan = make(chan string)
+	a.start(func() { a.h(room, a.input, a.cmdChan) })
+	return nil
+}
+
+func (a *handlerAdapter) HandlePacket(ctx context.Context, packet *PacketEvent) error {
+	return a.pass(ctx, a.input, packet)
+}
+
+func (a *handlerAdapter) Close() error {
+	select {
+	case a.cmdChan <- "kill":
+		<-a.done
+	case <-a.done:
+	}
+	return nil
+}
+
+func (a *handlerAdapter) Reconfigure(options json.RawMessage) error {
+	a.Close()
+	return a.Init(a.room)
+}
+
+// handlerPayload decodes the payload of a packet passed to a Handler as a T,
+// logging and returning nil if it is invalid.
+func handlerPayload[T any](room *Room, packet *PacketEvent) *T {
+	payload, err := DecodePayload[T](packet)
+	if err != nil {
+		room.Logger.Errorf("Invalid %s packet: %s", packet.Type, err)
+		return nil
+	}
+	return payload
+}
+
+// runHandler is the loop a started handler runs in, passing it packets and
+// acting on control messages until it is stopped. A handler that panics, whose
+// function returns by itself, or that fails to initialize when restarted, is
+// closed and restarted after a delay, or disabled once it has crashed more
+// than the room's HandlerCrashLimit. Crashes are forgotten once it has run for
+// handlerCrashResetPeriod without crashing.
+func (r *Room) runHandler(rh *runningHandler) {
+	paused := false
+	crashes := 0
+	var lastCrash time.Time
+	var restart <-chan time.Time
+	crashed := func(err error) {
+		if time.Since(lastCrash) > handlerCrashResetPeriod {
+			crashes = 0
+		}
+		crashes++
+		lastCrash = time.Now()
+		if perr, ok := err.(*PanicError); ok {
+			r.Logger.Errorf("Handler %s: %s\n%s", rh.name, perr, perr.Stack)
+		} else {
+			r.Logger.Errorf("Handler %s: %s", rh.name, err)
+		}
+		if err := callHandler(nil, rh.handler.Close); err != nil {
+			r.Logger.Errorf("Handler %s: error closing: %s", rh.name, err)
+		}
+		rh.handler = nil
+		cfg := r.roomConfig()
+		limit := cfg.HandlerCrashLimit
+		if limit == 0 {
+			limit = defaultHandlerCrashLimit
+		}
+		if crashes > limit {
+			r.Logger.Errorf("Handler %s: crashed %d times, disabling.", rh.name, crashes)
+			go r.DisableHandler(rh.name)
+			return
+		}
+		delay := cfg.HandlerRestartDelay
+		if delay == 0 {
+			delay = defaultHandlerRestartDelay
+		}
+		for i := 1; i < crashes && delay < maxHandlerRestartDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxHandlerRestartDelay {
+			delay = maxHandlerRestartDelay
+		}
+		r.Logger.Warningf("Handler %s: restarting in %s.", rh.name, delay)
+		restart = time.After(delay)
+	}
+	// check logs an error returned by the handler, treating panics and
+	// function handlers returning by themselves as crashes.
+	check := func(action string, err error) {
+		if _, ok := err.(*PanicError); ok || err == errHandlerExited {
+			crashed(err)
+		} else if err != nil && r.ctx.Err() == nil {
+			r.Logger.Errorf("Handler %s: error %s: %s", rh.name, action, err)
+		}
+	}
+	for {
+		select {
+		case packet := <-rh.input:
+			if paused || rh.handler == nil {
+				continue
+			}
+			check(fmt.Sprintf("handling %s packet", packet.Type), callHandler(&packet, func() error {
+				return rh.handler.HandlePacket(r.ctx, &packet)
+			}))
+		case <-restart:
+			restart = nil
+			rh.handler = rh.newHandler()
+			err := callHandler(nil, func() error { return rh.handler.Init(r) })
+			if err != nil {
+				crashed(fmt.Errorf("error restarting: %s", err))
+				continue
+			}
+			r.Logger.Infof("Handler %s: restarted after %d crashes.", rh.name, crashes)
+		case c := <-rh.control:
+			if c.Type == ControlStop {
+				if rh.handler != nil {
+					if err := callHandler(nil, rh.handler.Close); err != nil {
+						r.Logger.Errorf("Handler %s: error closing: %s", rh.name, err)
+					}
+				}
+				c.Ack()
+				return
+			}
+			var err error
+			switch c.Type {
+			case ControlPause:
+				paused = true
+			case ControlResume:
+				paused = false
+			case ControlReconfigure:
+				if rc, ok := rh.handler.(Reconfigurer); ok {
+					err = callHandler(nil, func() error { return rc.Reconfigure(c.Options) })
+				}
+			case ControlFlush:
+				if f, ok := rh.handler.(Flusher); ok {
+					err = callHandler(nil, f.Flush)
+				}
+			}
+			check(fmt.Sprintf("on %s", c.Type), err)
+			c.Ack()
+		}
+	}
+}
+
+// startHandler creates and initializes a handler, then starts its loop. It
+// returns nil if the handler could not be initialized.
+func (r *Room) startHandler(nh namedHandler) *runningHandler {
+	rh := &runningHandler{nh, nh.newHandler(), make(chan PacketEvent, 4), make(chan *Control, 1)}
+	if err := callHandler(nil, func() error { return rh.handler.Init(r) }); err != nil {
+		r.Logger.Errorf("Handler %s: error initializing, not started: %s", nh.name, err)
+		return nil
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.runHandler(rh)
+	}()
+	return rh
+}
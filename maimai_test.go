@@ -1,7 +1,13 @@
 package maimai
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -16,12 +22,16 @@ type MockSenderReceiver struct {
 	stopFlag bool
 	room     string
 	wg       sync.WaitGroup
+
+	reconnected chan empty
+	pms         chan *MockSenderReceiver
 }
 
 func NewMockSR(room string) *MockSenderReceiver {
 	outbound := make(chan *PacketEvent, 4)
 	inbound := make(chan *PacketEvent, 4)
-	return &MockSenderReceiver{outbound, inbound, false, room, sync.WaitGroup{}}
+	return &MockSenderReceiver{outbound, inbound, false, room, sync.WaitGroup{}, make(chan empty, 1),
+		make(chan *MockSenderReceiver, 1)}
 }
 
 func (m *MockSenderReceiver) connect(r *Room) error {
@@ -69,6 +79,19 @@ func (m *MockSenderReceiver) stop() {
 	m.stopFlag = true
 }
 
+func (m *MockSenderReceiver) openPM(pmID string) SenderReceiver {
+	pm := NewMockSR("pm:" + pmID)
+	m.pms <- pm
+	return pm
+}
+
+func (m *MockSenderReceiver) reconnect() {
+	select {
+	case m.reconnected <- empty{}:
+	default:
+	}
+}
+
 type TestHarness struct {
 	outbound *chan *PacketEvent
 	inbound  *chan *PacketEvent
@@ -84,7 +107,7 @@ func NewTestHarness(t *testing.T) (*Room, *TestHarness) {
 		Nick:         "MaiMai",
 	}
 	mockSR := NewMockSR("test")
-	room, err := NewRoom(roomCfg, "test", mockSR, logrus.New())
+	room, err := NewRoomWithStore(roomCfg, "test", mockSR, NewMemStore(), logrus.New())
 	if err != nil {
 		panic(err)
 	}
@@ -156,6 +179,24 @@ func (th *TestHarness) AssertReceivedAuth() {
 	}
 }
 
+func (th *TestHarness) AssertReceivedLog(before string) {
+	packet := <-*th.outbound
+	if packet.Type != LogType {
+		th.t.Fatalf("Incorrect packet type. Expected 'log', got '%s'.", packet.Type)
+	}
+	payload, err := packet.Payload()
+	if err != nil {
+		th.t.Fatalf("Could not extract packet payload. Error: %s", err)
+	}
+	data, ok := payload.(*LogCommand)
+	if !ok {
+		th.t.Fatal("Could not assert payload as *LogCommand.")
+	}
+	if data.Before != before {
+		th.t.Fatalf("Incorrect log before. Expected '%s', got '%s'.", before, data.Before)
+	}
+}
+
 func (th *TestHarness) SendSendEvent(text string, parent string, sender string) {
 	payload, _ := json.Marshal(Message{
 		Content: text,
@@ -167,6 +208,33 @@ func (th *TestHarness) SendSendEvent(text string, parent string, sender string)
 	*th.inbound <- &msg
 }
 
+func (th *TestHarness) SendMessage(ptype PacketType, msg interface{}) {
+	payload, _ := json.Marshal(msg)
+	*th.inbound <- &PacketEvent{
+		Type: ptype,
+		Data: payload}
+}
+
+func (th *TestHarness) SendReply(id string, ptype PacketType, msg interface{}) {
+	payload, _ := json.Marshal(msg)
+	*th.inbound <- &PacketEvent{
+		ID:   id,
+		Type: ptype,
+		Data: payload}
+}
+
+func (th *TestHarness) ReceiveEdit() (string, *EditMessageCommand) {
+	packet := <-*th.outbound
+	if packet.Type != EditMessageType {
+		th.t.Fatalf("Incorrect packet type. Expected 'edit-message', got '%s'.", packet.Type)
+	}
+	var data EditMessageCommand
+	if err := json.Unmarshal(packet.Data, &data); err != nil {
+		th.t.Fatalf("Could not extract packet payload. Error: %s", err)
+	}
+	return packet.ID, &data
+}
+
 func (th *TestHarness) SendPingEvent() {
 	payload, _ := json.Marshal(PingEvent{
 		Time: time.Now().Unix(),
@@ -196,9 +264,17 @@ func (th *TestHarness) SendPresenceEvent(ptype PacketType, name string) {
 	*th.inbound <- &msg
 }
 
+func (th *TestHarness) SendLogReply(log []Message) {
+	payload, _ := json.Marshal(LogReply{Log: log})
+	msg := PacketEvent{
+		Type: LogReplyType,
+		Data: payload}
+	*th.inbound <- &msg
+}
+
 func TestConnect(t *testing.T) {
 	room, _ := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
 	if err := room.sr.connect(room); err != nil {
 		t.Fatal("Could not connect to mock interface.")
 	}
@@ -206,14 +282,14 @@ func TestConnect(t *testing.T) {
 
 func TestRun(t *testing.T) {
 	room, _ := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
 	go room.Run()
 	room.Stop()
 }
 
 func TestSendText(t *testing.T) {
 	room, th := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
 	defer room.Stop()
 	go room.Run()
 	room.SendText("test text", "")
@@ -222,7 +298,7 @@ func TestSendText(t *testing.T) {
 
 func TestPingCommand(t *testing.T) {
 	room, th := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
 	defer room.Stop()
 	go room.Run()
 	th.SendSendEvent("!ping", "", "test")
@@ -231,7 +307,7 @@ func TestPingCommand(t *testing.T) {
 
 func TestScritchCommand(t *testing.T) {
 	room, th := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
 	go room.Run()
 	th.SendSendEvent("!scritch", "", "test")
 	th.AssertReceivedSendText("/me bruxes")
@@ -240,8 +316,9 @@ func TestScritchCommand(t *testing.T) {
 
 func TestSeenCommand(t *testing.T) {
 	room, th := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
 	go room.Run()
+	th.SendSendEvent("!seen", "", "test")
 	th.SendSendEvent("!seen @xyz", "", "test")
 	th.AssertReceivedSendText("User has not been seen yet.")
 	th.SendSendEvent("!seen @test", "", "test")
@@ -251,7 +328,7 @@ func TestSeenCommand(t *testing.T) {
 
 func TestUptimeCommand(t *testing.T) {
 	room, th := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
 	go room.Run()
 	th.SendSendEvent("!uptime", "", "test")
 	th.AssertReceivedSendPrefix("This bot has been up for")
@@ -260,7 +337,9 @@ func TestUptimeCommand(t *testing.T) {
 
 func TestLinkTitle(t *testing.T) {
 	room, th := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
+	room.config.HandlerOptions = map[string]json.RawMessage{
+		"link-title": json.RawMessage(`{"placeholder_delay": "1m"}`)}
 	go room.Run()
 	th.SendSendEvent("google.com", "", "test")
 	th.AssertReceivedSendText("Link title: Google")
@@ -302,7 +381,7 @@ func TestLinkTitle(t *testing.T) {
 func TestPingReply(t *testing.T) {
 	room, th := NewTestHarness(t)
 	go room.Run()
-	defer room.db.Close()
+	defer room.store.Close()
 	defer room.Stop()
 	th.SendPingEvent()
 	packet := <-*th.outbound
@@ -330,7 +409,7 @@ func TestWS(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	defer room.db.Close()
+	defer room.store.Close()
 	defer room.Stop()
 	room.SendNick(roomCfg.Nick)
 	go room.Run()
@@ -339,7 +418,7 @@ func TestWS(t *testing.T) {
 
 func TestNickChange(t *testing.T) {
 	room, th := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
 	go room.Run()
 	th.SendNickEvent("test1", "test2")
 	th.AssertReceivedSendText("< test1 is now known as test2. >")
@@ -348,7 +427,7 @@ func TestNickChange(t *testing.T) {
 
 func TestJoin(t *testing.T) {
 	room, th := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
 	go room.Run()
 	th.SendNickEvent("", "test1")
 	th.AssertReceivedSendText("< test1 joined the room. >")
@@ -362,7 +441,7 @@ func TestPart(t *testing.T) {
 		t.Skip("skipping test in short mode.")
 	}
 	room, th := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
 	defer room.Stop()
 	go room.Run()
 	th.SendPresenceEvent("part-event", "test1")
@@ -388,17 +467,1275 @@ func TestBadWS(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	defer room.db.Close()
+	defer room.store.Close()
 	// defer room.Stop()
 	go room.Run()
 }
 
 func TestSendAuth(t *testing.T) {
 	room, th := NewTestHarness(t)
-	defer room.db.Close()
+	defer room.store.Close()
 	defer room.Stop()
 	room.config.Password = "test"
 	go room.Run()
 	room.SendAuth()
 	th.AssertReceivedAuth()
 }
+
+func TestLogBackfill(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	go room.Run()
+	room.startBackfill()
+	select {
+	case packet := <-*th.outbound:
+		t.Fatalf("Backfilled an empty message log, sent '%s'.", packet.Type)
+	case <-time.After(time.Duration(100) * time.Millisecond):
+	}
+	room.storeMsgLogEvent("0000000000001", &MsgLogEvent{})
+	room.startBackfill()
+	th.AssertReceivedLog("")
+	var page []Message
+	for i := 0; i < logPageSize; i++ {
+		page = append(page, Message{
+			ID:     fmt.Sprintf("%013d", i+100),
+			Sender: User{ID: "agent:backfill", Name: "backfill user"}})
+	}
+	th.SendLogReply(page)
+	th.AssertReceivedLog("0000000000100")
+	th.SendLogReply([]Message{{
+		ID:     "0000000000002",
+		Time:   1,
+		Sender: User{ID: "agent:backfill", Name: "backfill user"}}})
+	select {
+	case packet := <-*th.outbound:
+		t.Fatalf("Unexpected packet of type '%s' after backfill completed.", packet.Type)
+	case <-time.After(time.Duration(300) * time.Millisecond):
+	}
+	logged, err := room.store.RetrieveMsgLogEvent("0000000000002")
+	if err != nil || logged == nil {
+		t.Fatal("Backfilled message was not logged.")
+	}
+	_, seen, err := room.store.RetrieveSeen("backfilluser")
+	if err != nil || !seen {
+		t.Fatal("Backfilled sender was not recorded as seen.")
+	}
+	room.config.MsgLogMaxCount = 1
+	room.startBackfill()
+	th.AssertReceivedLog("")
+	th.SendLogReply(page)
+	select {
+	case packet := <-*th.outbound:
+		t.Fatalf("Backfilled past MsgLogMaxCount, sent '%s'.", packet.Type)
+	case <-time.After(time.Duration(300) * time.Millisecond):
+	}
+}
+
+func TestMessageEditHistory(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	go room.Run()
+	msgID := "00000000000e1"
+	sender := User{ID: "agent:editor", Name: "editor"}
+	room.storeMsgLogEvent(msgID, &MsgLogEvent{
+		UserID:   sender.ID,
+		UserName: sender.Name,
+		Time:     0,
+		Content:  "helo"})
+	th.SendMessage(EditMessageEventType, EditMessageEvent{
+		EditID:  "edit1",
+		Message: Message{ID: msgID, Sender: sender, Content: "hello", Edited: 60}})
+	th.SendMessage(EditMessageEventType, EditMessageEvent{
+		EditID:  "edit2",
+		Message: Message{ID: msgID, Sender: sender, Content: "hello", Edited: 60, Deleted: 120}})
+	for i := 0; ; i++ {
+		msg, err := room.store.RetrieveMsgLogEvent(msgID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Deleted != 0 {
+			break
+		}
+		if i == 30 {
+			t.Fatal("Timeout: message deletion was not logged.")
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	th.SendSendEvent("!history "+msgID, "", "test")
+	th.AssertReceivedSendText("Only moderators can view message history.")
+	th.SendMessage(SendEventType, Message{
+		Content: "!history " + msgID,
+		Sender:  User{Name: "mod", IsManager: true}})
+	th.AssertReceivedSendText("1. 1970-01-01T00:00:00Z by editor: helo\n" +
+		"2. 1970-01-01T00:01:00Z by editor: hello\n" +
+		"Deleted 1970-01-01T00:02:00Z.")
+}
+
+func testStore(t *testing.T, store Store) {
+	if err := store.StoreSeen("test", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreSeenTimes(map[string]int64{"test": 5, "other": 7}); err != nil {
+		t.Fatal(err)
+	}
+	if seen, ok, err := store.RetrieveSeen("test"); err != nil || !ok || seen != 10 {
+		t.Fatalf("Incorrect seen time. Expected 10, got %d.", seen)
+	}
+	if _, ok, _ := store.RetrieveSeen("nobody"); ok {
+		t.Fatal("Unexpected seen time for unseen user.")
+	}
+	store.StoreMsgLog([]Message{{ID: "002", Content: "b"}, {ID: "001", Content: "a"}})
+	if latest, err := store.LatestMsgLogID(); err != nil || latest != "002" {
+		t.Fatalf("Incorrect latest message ID. Expected '002', got '%s'.", latest)
+	}
+	errRollback := errors.New("rollback")
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(msgLogBucket)
+		if err != nil {
+			return err
+		}
+		b.Delete([]byte("001"))
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("Expected rollback error, got %v.", err)
+	}
+	if msg, err := store.RetrieveMsgLogEvent("001"); err != nil || msg == nil || msg.Content != "a" {
+		t.Fatal("Rolled back delete was applied.")
+	}
+	err = store.View(func(tx Tx) error {
+		b, err := tx.Bucket("Missing")
+		if err != nil {
+			return err
+		}
+		if b.Get([]byte("key")) != nil {
+			t.Fatal("Missing bucket is not empty.")
+		}
+		return b.Put([]byte("key"), []byte("value"))
+	})
+	if err != ErrTxNotWritable {
+		t.Fatalf("Expected ErrTxNotWritable, got %v.", err)
+	}
+}
+
+func TestStores(t *testing.T) {
+	testStore(t, NewMemStore())
+	os.Remove("test_store.db")
+	defer os.Remove("test_store.db")
+	store, err := NewBoltStore("test_store.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testStore(t, store)
+}
+
+func TestHandlerKV(t *testing.T) {
+	room, _ := NewTestHarness(t)
+	defer room.store.Close()
+	kv := room.KV("test-handler")
+	if err := kv.PutJSON("count", 3); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if ok, err := kv.GetJSON("count", &count); err != nil || !ok || count != 3 {
+		t.Fatalf("Incorrect value. Expected 3, got %d.", count)
+	}
+	if value, _ := room.KV("other-handler").Get("count"); value != nil {
+		t.Fatal("Handler KV stores are not namespaced.")
+	}
+	kv.Update(func(b Bucket) error {
+		b.Put([]byte("a"), []byte("1"))
+		b.Delete([]byte("count"))
+		if string(b.Get([]byte("a"))) != "1" || b.Get([]byte("count")) != nil {
+			t.Fatal("Transaction does not see its own changes.")
+		}
+		if k, _ := b.Last(); string(k) != "a" {
+			t.Fatalf("Incorrect last key in transaction. Expected 'a', got '%s'.", k)
+		}
+		return errors.New("rollback")
+	})
+	if value, _ := kv.Get("a"); value != nil {
+		t.Fatal("Rolled back put was applied.")
+	}
+	if ok, _ := kv.GetJSON("count", &count); !ok {
+		t.Fatal("Rolled back delete was applied.")
+	}
+	kv.Delete("count")
+	if ok, _ := kv.GetJSON("count", &count); ok {
+		t.Fatal("Deleted value is still present.")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	store := NewMemStore()
+	report, err := Migrate(store, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.From != 0 || report.To != SchemaVersion || len(report.Changes) == 0 {
+		t.Fatalf("Incorrect dry run report: %s", report)
+	}
+	if version, _ := StoredSchemaVersion(store); version != 0 {
+		t.Fatalf("Dry run changed schema version to %d.", version)
+	}
+	if _, err := Migrate(store, false); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := StoredSchemaVersion(store); version != SchemaVersion {
+		t.Fatalf("Incorrect schema version. Expected %d, got %d.", SchemaVersion, version)
+	}
+	report, err = Migrate(store, true)
+	if err != nil || report.From != SchemaVersion || len(report.Changes) != 0 {
+		t.Fatalf("Expected up to date schema, got: %s", report)
+	}
+	store.Update(func(tx Tx) error {
+		b, _ := tx.Bucket(metaBucket)
+		return b.Put(schemaVersionKey, []byte(strconv.Itoa(SchemaVersion+1)))
+	})
+	if _, err := Migrate(store, false); err == nil {
+		t.Fatal("Expected error migrating a newer schema.")
+	}
+}
+
+func TestPruneMsgLog(t *testing.T) {
+	room, _ := NewTestHarness(t)
+	defer room.store.Close()
+	now := time.Now().Unix()
+	room.store.StoreMsgLog([]Message{
+		{ID: "001", Time: now - 7200},
+		{ID: "002", Time: now - 60},
+		{ID: "003", Time: now - 30},
+		{ID: "004", Time: now}})
+	room.config.MsgLogMaxAge = time.Hour
+	room.config.MsgLogMaxCount = 2
+	room.pruneMsgLog()
+	for id, kept := range map[string]bool{"001": false, "002": false, "003": true, "004": true} {
+		msg, err := room.store.RetrieveMsgLogEvent(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (msg != nil) != kept {
+			t.Fatalf("Message %s: expected kept to be %v.", id, kept)
+		}
+	}
+}
+
+func TestForgetUser(t *testing.T) {
+	room, _ := NewTestHarness(t)
+	defer room.store.Close()
+	room.store.StoreMsgLog([]Message{
+		{ID: "001", Sender: User{ID: "agent:forget", Name: "forget me"}},
+		{ID: "002", Sender: User{ID: "agent:forget", Name: "renamed"}},
+		{ID: "003", Sender: User{ID: "agent:keep", Name: "keep"}},
+		{ID: "004", Sender: User{ID: "agent:forget", Name: "shared"}},
+		{ID: "005", Sender: User{ID: "agent:other", Name: "shared"}}})
+	room.store.StoreSeen("forgetme", 1)
+	room.store.StoreSeen("renamed", 1)
+	room.store.StoreSeen("keep", 1)
+	room.store.StoreSeen("shared", 1)
+	msgs, seen, err := room.ForgetUser("agent:forget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs != 3 || seen != 2 {
+		t.Fatalf("Expected 3 messages and 2 seen records removed, got %d and %d.", msgs, seen)
+	}
+	if _, ok, _ := room.store.RetrieveSeen("shared"); !ok {
+		t.Fatal("Seen record of a nick shared with another user was removed.")
+	}
+	if msg, _ := room.store.RetrieveMsgLogEvent("003"); msg == nil {
+		t.Fatal("Another user's message was removed.")
+	}
+	if _, ok, _ := room.store.RetrieveSeen("keep"); !ok {
+		t.Fatal("Another user's seen record was removed.")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig("test.json", []byte(`{
+	"transport": {"retry_delay": "5s"},
+	"rooms": [
+		{"room": "test", "msglog": true, "msglog_max_age": "720h"},
+		{"room": "other", "nick": "Other", "handlers": ["ping-event", "ping-command"],
+		 "handler_options": {"ping-command": {"x": 1}}}
+	]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Rooms) != 2 || cfg.Transport.RetryDelay.Duration != 5*time.Second {
+		t.Fatal("Config was not parsed correctly.")
+	}
+	roomCfg := cfg.Rooms[0].RoomConfig()
+	if roomCfg.Nick != defaultNick || roomCfg.DBPath != "room_test.db" || roomCfg.MsgLogMaxAge != 720*time.Hour {
+		t.Fatalf("Incorrect room config: %+v", roomCfg)
+	}
+	room, err := NewRoomWithStore(cfg.Rooms[1].RoomConfig(), "other", NewMockSR("other"), NewMemStore(), logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(room.handlers) != 2 {
+		t.Fatalf("Expected 2 handlers, got %d.", len(room.handlers))
+	}
+	var opts struct{ X int }
+	if ok, err := room.HandlerOptions("ping-command", &opts); !ok || err != nil || opts.X != 1 {
+		t.Fatal("Handler options were not passed to the room.")
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	cases := map[string]string{
+		"{\n\"rooms\": [\n{\"room\": \"test\",\n\"handlers\": [\"nope\"]}]}":  "test.json:4: unknown handler \"nope\"",
+		"{\n\"rooms\": [\n{\"room\": \"test\",\n\"nick\": 1}]}":               "test.json:4: rooms.0.nick must be of type string, not number",
+		"{\n\"rooms\": [\n{\"room\": \"test\",\n\"bogus\": 1}]}":              "test.json:4: unknown field \"rooms.0.bogus\"",
+		"{\n\"rooms\": [\n{\"room\": \"test\"}],\n\"room\": 1}":               "test.json:4: unknown field \"room\"",
+		"{\n\"rooms\": [\n{\"room\": \"test\",\n\"loop_window\": \"soon\"}]}": "test.json:4: rooms.0.loop_window: time: invalid duration \"soon\"",
+		"{\n\"rooms\": [\n{\"room\": \"test\",\n}]}":                          "test.json:4: invalid character '}' looking for beginning of object key string",
+		"{\n\"rooms\": [\n{\"nick\": \"test\"}]}":                             "test.json:3: room name is required",
+	}
+	for data, expected := range cases {
+		_, err := ParseConfig("test.json", []byte(data))
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected error '%s', got '%v'.", expected, err)
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	go room.Run()
+	cfg := *room.config
+	cfg.Nick = "MaiMai2"
+	cfg.Handlers = []string{"ping-command", "scritch-command"}
+	cfg.DBPath = "other.db"
+	room.SetConfigLoader(func() (*RoomConfig, error) {
+		return &cfg, nil
+	})
+	report, err := room.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	th.AssertReceivedNick()
+	if len(report.Skipped) != 1 || room.roomConfig().DBPath != "test.db" {
+		t.Fatalf("Expected db path change to be skipped, got: %s", report)
+	}
+	if len(room.handlers) != 2 {
+		t.Fatalf("Expected 2 handlers running, got %d.", len(room.handlers))
+	}
+	th.SendSendEvent("!uptime", "", "test")
+	th.SendSendEvent("!ping", "", "test")
+	th.AssertReceivedSendText("pong!")
+	if _, err := room.Reconfigure(&RoomConfig{Handlers: []string{"nope"}}); err == nil {
+		t.Fatal("Expected error reconfiguring with an unknown handler.")
+	}
+	room.Stop()
+	if !room.Stopped() {
+		t.Fatal("Room not stopped.")
+	}
+	if _, err := room.SetNick("MaiMai3"); err == nil {
+		t.Fatal("Expected error reconfiguring a stopped room.")
+	}
+}
+
+func TestAdminCommand(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	room.config.Owners = []string{"agent:owner"}
+	go room.Run()
+	owner := User{ID: "agent:owner", Name: "owner"}
+	th.SendMessage(SendEventType, Message{
+		Content: "!admin nick Evil",
+		Sender:  User{ID: "agent:other", Name: "other"}})
+	th.AssertReceivedSendText("You are not allowed to use admin commands.")
+	th.SendMessage(SendEventType, Message{Content: "!admin disable scritch-command", Sender: owner})
+	th.AssertReceivedSendText("Disabled handler scritch-command.")
+	th.SendSendEvent("!scritch", "", "test")
+	th.SendMessage(SendEventType, Message{Content: "!admin nick MaiMai2", Sender: owner})
+	// The nick and the reply are sent concurrently, so may arrive in either order.
+	for i := 0; i < 2; i++ {
+		if packet := <-*th.outbound; packet.Type != NickType && packet.Type != SendType {
+			t.Fatalf("Unexpected packet of type %s.", packet.Type)
+		}
+	}
+	if nick := room.roomConfig().Nick; nick != "MaiMai2" {
+		t.Fatalf("Nick not changed, got %s.", nick)
+	}
+	entries, err := room.AdminAuditLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Allowed || !entries[1].Allowed ||
+		entries[2].Command != "!admin nick MaiMai2" {
+		t.Fatalf("Incorrect audit log: %+v", entries)
+	}
+}
+
+// controlRecorder is a PacketHandler recording the control messages that
+// reach it.
+type controlRecorder struct {
+	received chan ControlType
+}
+
+func (h *controlRecorder) Init(room *Room) error {
+	return nil
+}
+
+func (h *controlRecorder) HandlePacket(ctx context.Context, packet *PacketEvent) error {
+	return nil
+}
+
+func (h *controlRecorder) Close() error {
+	h.received <- ControlStop
+	return nil
+}
+
+func (h *controlRecorder) Flush() error {
+	h.received <- ControlFlush
+	return nil
+}
+
+func TestHandlerControl(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	received := make(chan ControlType, 8)
+	room.AddHandler("recorder", HandlerFactoryFunc(func() PacketHandler {
+		return &controlRecorder{received}
+	}))
+	go room.Run()
+
+	if err := room.PauseHandler("scritch-command"); err != nil {
+		t.Fatal(err)
+	}
+	th.SendSendEvent("!scritch", "", "test")
+	// Let the packet reach the paused handler before resuming it.
+	time.Sleep(200 * time.Millisecond)
+	if err := room.ResumeHandler("scritch-command"); err != nil {
+		t.Fatal(err)
+	}
+	th.SendSendEvent("!scritch", "", "test")
+	th.AssertReceivedSendText("/me bruxes")
+	select {
+	case packet := <-*th.outbound:
+		t.Fatalf("Paused handler replied: %+v", packet)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for _, f := range []func(string) error{room.PauseHandler, room.ResumeHandler, room.FlushHandler} {
+		if err := f("recorder"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := room.PauseHandler("missing"); err == nil {
+		t.Fatal("Paused a handler that is not running.")
+	}
+	room.Stop()
+	var types []ControlType
+	close(received)
+	for ct := range received {
+		types = append(types, ct)
+	}
+	// Pausing and resuming is done by the room, so does not reach the handler.
+	if fmt.Sprint(types) != fmt.Sprint([]ControlType{ControlFlush, ControlStop}) {
+		t.Fatalf("Incorrect control messages received: %v", types)
+	}
+}
+
+type testPacketHandler struct {
+	room   *Room
+	events chan string
+}
+
+func (h *testPacketHandler) Init(room *Room) error {
+	h.room = room
+	h.events <- "init"
+	return nil
+}
+
+func (h *testPacketHandler) HandlePacket(ctx context.Context, packet *PacketEvent) error {
+	if packet.Type != SendEventType {
+		return nil
+	}
+	data, err := GetMessagePayload(packet)
+	if err != nil {
+		return err
+	}
+	switch data.Content {
+	case "panic":
+		panic("test panic")
+	case "error":
+		return errors.New("test error")
+	}
+	h.events <- "packet"
+	return nil
+}
+
+func (h *testPacketHandler) Close() error {
+	h.events <- "close"
+	return nil
+}
+
+func TestPacketHandler(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	room.config.HandlerCrashLimit = 1
+	room.config.HandlerRestartDelay = 10 * time.Millisecond
+	h := &testPacketHandler{events: make(chan string, 8)}
+	newHandler := HandlerFactoryFunc(func() PacketHandler { return h })
+	if err := room.AddHandler("test-packet", newHandler); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.AddHandler("test-packet", newHandler); err == nil {
+		t.Fatal("Expected error adding handler with a name in use.")
+	}
+	if err := room.AddHandler("seen-command", MessageHandler(SeenCommandHandler)); err == nil {
+		t.Fatal("Expected error adding handler with a configured handler's name.")
+	}
+	go room.Run()
+	expect := func(event string) {
+		select {
+		case got := <-h.events:
+			if got != event {
+				t.Fatalf("Expected handler event '%s', got '%s'.", event, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for handler event '%s'.", event)
+		}
+	}
+	expect("init")
+	th.SendSendEvent("panic", "", "test")
+	expect("close")
+	expect("init")
+	th.SendSendEvent("error", "", "test")
+	th.SendSendEvent("hello", "", "test")
+	expect("packet")
+
+	// A second crash is over the limit, so the handler is disabled.
+	th.SendSendEvent("panic", "", "test")
+	expect("close")
+	for i := 0; room.PauseHandler("test-packet") == nil; i++ {
+		if i == 100 {
+			t.Fatal("Handler not disabled after crashing too often.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	room.Stop()
+	select {
+	case event := <-h.events:
+		t.Fatalf("Unexpected handler event '%s' after disabling.", event)
+	default:
+	}
+}
+
+func TestHandlerExit(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	room.config.HandlerCrashLimit = 1
+	room.config.HandlerRestartDelay = 10 * time.Millisecond
+	started := make(chan empty, 4)
+	room.AddHandler("test-exit", Handler(func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		started <- empty{}
+		select {
+		case <-input:
+		case <-cmdChan:
+		}
+	}))
+	go room.Run()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("Handler not started %d times.", i+1)
+		}
+		// The handler returns on the first packet, which the second finds.
+		th.SendSendEvent("hello", "", "test")
+		th.SendSendEvent("hello", "", "test")
+	}
+	for i := 0; room.FlushHandler("test-exit") == nil; i++ {
+		if i == 100 {
+			t.Fatal("Handler not disabled after exiting too often.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDecodePayload(t *testing.T) {
+	packet, err := MakePacket("1", SendEventType, Message{ID: "a", Content: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := DecodePayload[Message](packet)
+	if err != nil || msg.Content != "hello" {
+		t.Fatalf("Could not decode send-event payload: %v, %v", msg, err)
+	}
+	if _, err := GetNickEventPayload(packet); err == nil {
+		t.Fatal("Decoded send-event payload as *NickEvent.")
+	} else if _, ok := err.(*PayloadTypeError); !ok {
+		t.Fatalf("Expected *PayloadTypeError, got %T: %s", err, err)
+	}
+	packet.Type = "unknown-event"
+	if _, err := GetMessagePayload(packet); err == nil {
+		t.Fatal("Decoded payload of unknown packet type.")
+	}
+	packet = &PacketEvent{Type: NickEventType, Data: json.RawMessage(`{"from": 1}`)}
+	if _, err := GetNickEventPayload(packet); err == nil {
+		t.Fatal("Decoded invalid nick-event payload.")
+	}
+}
+
+func TestValidatePacket(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendMessage(SendEventType, map[string]interface{}{"content": "!scritch"})
+	th.SendMessage(SendEventType, map[string]interface{}{
+		"id": "a", "sender": User{Name: "test"}, "content": 1})
+	th.SendMessage("new-event", map[string]interface{}{"x": 1})
+	th.SendMessage(SendEventType, map[string]interface{}{
+		"id": "b", "sender": User{Name: "test"}, "content": "!scritch", "new_field": true})
+	th.AssertReceivedSendText("/me bruxes")
+
+	stats := room.PacketStats()
+	if stats.Malformed[SendEventType] != 2 || stats.UnknownTypes["new-event"] != 1 ||
+		stats.UnknownFields[SendEventType] != 1 {
+		t.Fatalf("Incorrect packet stats: %+v", stats)
+	}
+	unknown, err := ValidatePacket(&PacketEvent{Type: EditMessageEventType,
+		Data: json.RawMessage(`{"edit_id": "e", "id": "a", "sender": {"id": "x", "client_address": "y"}, "z": 1}`)})
+	if err != nil || fmt.Sprint(unknown) != "[z]" {
+		t.Fatalf("Incorrect validation of edit-message-event: %v, %v", unknown, err)
+	}
+}
+
+// benchmarkHandlers is how many handlers read each message in the payload
+// benchmarks.
+const benchmarkHandlers = 8
+
+func benchmarkSendEvent(b *testing.B) *PacketEvent {
+	packet, err := MakePacket("1", SendEventType, Message{
+		ID:      "a",
+		Time:    time.Now().Unix(),
+		Sender:  User{ID: "agent:test", Name: "test"},
+		Content: "!seen @someone"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return packet
+}
+
+// BenchmarkPayloadPerHandler has every handler decode a send-event itself.
+func BenchmarkPayloadPerHandler(b *testing.B) {
+	packet := benchmarkSendEvent(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkHandlers; j++ {
+			p := PacketEvent{Type: packet.Type, Data: packet.Data}
+			if _, err := GetMessagePayload(&p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkPayloadDecodeOnce decodes a send-event and its sender's session
+// once, as the dispatcher does, and has every handler read them from its copy.
+func BenchmarkPayloadDecodeOnce(b *testing.B) {
+	packet := benchmarkSendEvent(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := PacketEvent{Type: packet.Type, Data: packet.Data}
+		if _, err := ValidatePacket(&p); err != nil {
+			b.Fatal(err)
+		}
+		p.senderSession = senderSessionID(&p)
+		for j := 0; j < benchmarkHandlers; j++ {
+			c := p
+			if _, err := GetMessagePayload(&c); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestCookieFile(t *testing.T) {
+	path := "test_cookies.json"
+	defer os.Remove(path)
+	cf, err := LoadCookieFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cf.Header()) != 0 {
+		t.Fatal("Empty cookie file sent cookies.")
+	}
+	if err := cf.Update([]*http.Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Update([]*http.Cookie{{Name: "a", Value: "3"}, {Name: "b", MaxAge: -1}}); err != nil {
+		t.Fatal(err)
+	}
+	cf, err = LoadCookieFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie := cf.Header().Get("Cookie"); cookie != "a=3" {
+		t.Fatalf("Incorrect cookies loaded, got '%s'.", cookie)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	room.config.Email = "bot@example.com"
+	room.config.AccountPassword = "secret"
+	room.AddHandler("login", handlerRegistry["login"])
+	go room.Run()
+	th.SendMessage(HelloEventType, HelloEvent{Session: SessionView{User: User{ID: "agent:bot"}}})
+	packet := <-*th.outbound
+	if packet.Type != LoginType {
+		t.Fatalf("Expected login packet, got %s.", packet.Type)
+	}
+	var login LoginCommand
+	if err := json.Unmarshal(packet.Data, &login); err != nil {
+		t.Fatal(err)
+	}
+	if login.Namespace != "email" || login.ID != "bot@example.com" || login.Password != "secret" {
+		t.Fatalf("Incorrect login command: %+v", login)
+	}
+	th.SendMessage(HelloEventType, HelloEvent{
+		Account: &Account{ID: "account:bot", Name: "bot"},
+		Session: SessionView{User: User{ID: "account:bot"}}})
+	select {
+	case packet := <-*th.outbound:
+		t.Fatalf("Logged in bot sent %s packet.", packet.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAuth(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	handlers, err := configuredHandlers(&RoomConfig{Handlers: []string{"ping-event"}, Password: "test"})
+	if err != nil || len(handlers) != 2 || handlers[1].name != "auth" {
+		t.Fatalf("Expected auth handler to be enabled for a room with a password, got %v.", handlers)
+	}
+	room.config.HandlerOptions = map[string]json.RawMessage{"auth": json.RawMessage(`{"attempts": 0}`)}
+	h := &AuthHandler{}
+	if err := h.Init(room); err != nil || h.opts.Attempts != defaultAuthAttempts {
+		t.Fatalf("Expected %d attempts by default, got %d.", defaultAuthAttempts, h.opts.Attempts)
+	}
+	room.config.Password = "test"
+	room.config.HandlerOptions = map[string]json.RawMessage{
+		"auth": json.RawMessage(`{"attempts": 2, "retry_delay": "10ms"}`)}
+	go room.Run()
+	th.SendMessage(BounceEventType, BounceEvent{Reason: "authentication required",
+		AuthOptions: []string{"passcode"}})
+	th.AssertReceivedAuth()
+	th.SendMessage(AuthReplyType, AuthReply{Success: false, Reason: "passcode incorrect"})
+	th.AssertReceivedAuth()
+	th.SendMessage(AuthReplyType, AuthReply{Success: false, Reason: "passcode incorrect"})
+	for i := 0; room.Err() == nil; i++ {
+		if i == 100 {
+			t.Fatal("Room not stopped after password was rejected.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := room.Err().(*AuthError); !ok {
+		t.Fatalf("Expected *AuthError, got %T: %s", room.Err(), room.Err())
+	}
+	room.Stop()
+}
+
+func TestConnectionSetup(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	ready := make(chan *ReadyEvent, 2)
+	room.AddHandler("test-ready", Handler(func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		for {
+			select {
+			case packet := <-input:
+				if packet.Type != ReadyEventType {
+					continue
+				}
+				data := handlerPayload[ReadyEvent](room, &packet)
+				if data == nil {
+					continue
+				}
+				ready <- data
+			case <-cmdChan:
+				return
+			}
+		}
+	}))
+	room.storeMsgLogEvent("0000000000001", &MsgLogEvent{})
+	go room.Run()
+	th.SendMessage(HelloEventType, HelloEvent{Session: SessionView{
+		User:      User{ID: "bot:test", Name: "MaiMai"},
+		SessionID: "test-session"}})
+	select {
+	case packet := <-*th.outbound:
+		t.Fatalf("Unexpected packet of type '%s' before snapshot-event.", packet.Type)
+	case <-time.After(200 * time.Millisecond):
+	}
+	th.SendMessage(SnapshotEventType, SnapshotEvent{SessionID: "test-session"})
+	sent := make(map[PacketType]bool)
+	for i := 0; i < 2; i++ {
+		sent[(<-*th.outbound).Type] = true
+	}
+	if !sent[NickType] || !sent[LogType] {
+		t.Fatalf("Expected nick and log packets after snapshot-event, got %v.", sent)
+	}
+	select {
+	case data := <-ready:
+		if data.Session.SessionID != "test-session" {
+			t.Fatalf("Incorrect ready session. Expected 'test-session', got '%s'.", data.Session.SessionID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for ready-event.")
+	}
+	th.SendMessage(SnapshotEventType, SnapshotEvent{SessionID: "test-session"})
+	select {
+	case packet := <-*th.outbound:
+		t.Fatalf("Unexpected packet of type '%s' after second snapshot-event.", packet.Type)
+	case <-ready:
+		t.Fatal("Unexpected second ready-event.")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSetupTimeout(t *testing.T) {
+	room, _ := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	room.config.SetupTimeout = 50 * time.Millisecond
+	go room.Run()
+	room.beginSetup()
+	select {
+	case <-room.sr.(*MockSenderReceiver).reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Connection not dropped after setup timed out.")
+	}
+}
+
+func TestNickCollision(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	room.config.NickSuffix = "_"
+	go room.Run()
+	th.SendMessage(HelloEventType, HelloEvent{Session: SessionView{
+		User:      User{ID: "bot:test"},
+		SessionID: "test-session"}})
+	th.SendMessage(SnapshotEventType, SnapshotEvent{
+		SessionID: "test-session",
+		Listing: []SessionView{{
+			User:      User{ID: "agent:other", Name: "mai mai"},
+			SessionID: "other-session"}}})
+	var nick *NickCommand
+	for i := 0; i < 2 && nick == nil; i++ {
+		packet := <-*th.outbound
+		if packet.Type == NickType {
+			data, err := GetNickCommandPayload(packet)
+			if err != nil {
+				t.Fatalf("Could not decode nick command: %s", err)
+			}
+			nick = data
+		}
+	}
+	if nick == nil || nick.Name != "MaiMai_" {
+		t.Fatalf("Expected nick 'MaiMai_', got %v.", nick)
+	}
+	th.SendMessage(NickReplyType, NickReply{
+		SessionID: "test-session",
+		ID:        "bot:test",
+		To:        "MaiMai_"})
+	for i := 0; room.Self().Name != "MaiMai_"; i++ {
+		if i == 100 {
+			t.Fatalf("Expected own nick 'MaiMai_', got '%s'.", room.Self().Name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if self := room.Self(); self.SessionID != "test-session" || self.ID != "bot:test" {
+		t.Fatalf("Incorrect own session: %+v", self)
+	}
+	if room.isSelfNick("MaiMai") || !room.isSelfNick("maimai_") {
+		t.Fatal("Mentions of the other session's nick are taken to be the bot's.")
+	}
+}
+
+func TestPM(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	room.config.Owners = []string{"account:owner"}
+	room.config.MaxPMs = 1
+	room.config.PMIdleTimeout = time.Second
+	go room.Run()
+	th.SendMessage(PMInitiateEventType, PMInitiateEvent{
+		From:     "account:owner",
+		FromNick: "owner",
+		FromRoom: "test",
+		PMID:     "test-pm"})
+	var pmSR *MockSenderReceiver
+	select {
+	case pmSR = <-room.sr.(*MockSenderReceiver).pms:
+	case <-time.After(time.Second):
+		t.Fatal("PM was not opened.")
+	}
+	pm := room.PMs()["test-pm"]
+	if pm == nil || pm.Parent() != room {
+		t.Fatal("PM room is not tracked by its parent.")
+	}
+	pmth := &TestHarness{&pmSR.outbound, &pmSR.inbound, t}
+	pmth.SendMessage(SnapshotEventType, SnapshotEvent{SessionID: "pm-session"})
+	pmth.AssertReceivedNick()
+	pmth.SendSendEvent("!seen @alice", "", "owner")
+	pmth.AssertReceivedSendText("User has not been seen yet.")
+	payload, _ := json.Marshal(Message{
+		Content: "!admin nick MaiMai2",
+		Sender:  User{ID: "account:owner", Name: "owner"}})
+	*pmth.inbound <- &PacketEvent{Type: SendEventType, Data: payload}
+	pmth.AssertReceivedSendText("Nick changed to MaiMai2.")
+	if nick := room.roomConfig().Nick; nick != "MaiMai2" {
+		t.Fatalf("Expected parent room's nick 'MaiMai2', got '%s'.", nick)
+	}
+	th.AssertReceivedNick()
+	cfg := *room.roomConfig()
+	cfg.Owners = nil
+	if _, err := room.Reconfigure(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	*pmth.inbound <- &PacketEvent{Type: SendEventType, Data: payload}
+	pmth.AssertReceivedSendText("You are not allowed to use admin commands.")
+	th.SendMessage(PMInitiateEventType, PMInitiateEvent{From: "agent:other", PMID: "other-pm"})
+	select {
+	case <-room.sr.(*MockSenderReceiver).pms:
+		t.Fatal("PM opened beyond MaxPMs.")
+	case <-time.After(200 * time.Millisecond):
+	}
+	for i := 0; len(room.PMs()) != 0; i++ {
+		if i == 300 {
+			t.Fatal("Idle PM room not closed.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	th.SendMessage(PMInitiateEventType, PMInitiateEvent{From: "agent:other", PMID: "other-pm"})
+	select {
+	case <-room.sr.(*MockSenderReceiver).pms:
+	case <-time.After(time.Second):
+		t.Fatal("PM was not opened after the idle one was closed.")
+	}
+	room.Stop()
+	for i := 0; len(room.PMs()) != 0; i++ {
+		if i == 100 {
+			t.Fatal("PM room not closed after its parent was stopped.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEditMessage(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	go room.Run()
+	sender := User{ID: "bot:test", Name: "MaiMai"}
+	sent := make(chan *Message)
+	go func() {
+		msg, err := room.SendTextWait("hello", "parent")
+		if err != nil {
+			t.Errorf("Error sending message: %s", err)
+		}
+		sent <- msg
+	}()
+	packet := <-*th.outbound
+	if packet.Type != SendType {
+		t.Fatalf("Incorrect packet type. Expected 'send', got '%s'.", packet.Type)
+	}
+	th.SendReply(packet.ID, SendReplyType, Message{ID: "m1", Sender: sender, Content: "hello"})
+	if msg := <-sent; msg == nil || msg.ID != "m1" {
+		t.Fatalf("Expected sent message 'm1', got %v.", msg)
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := room.EditMessage("m1", "goodbye")
+		errs <- err
+	}()
+	id, edit := th.ReceiveEdit()
+	if edit.ID != "m1" || edit.PreviousEditID != "" || edit.Content != "goodbye" || edit.Delete {
+		t.Fatalf("Incorrect edit command: %+v", edit)
+	}
+	th.SendReply(id, EditMessageReplyType, EditMessageReply{EditID: "e1",
+		Message: Message{ID: "m1", Sender: sender, Content: "goodbye"}})
+	if err := <-errs; err != nil {
+		t.Fatalf("Error editing message: %s", err)
+	}
+
+	go func() {
+		errs <- room.DeleteMessage("m1")
+	}()
+	id, edit = th.ReceiveEdit()
+	if edit.ID != "m1" || edit.PreviousEditID != "e1" || !edit.Delete {
+		t.Fatalf("Incorrect delete command: %+v", edit)
+	}
+	*th.inbound <- &PacketEvent{ID: id, Type: EditMessageReplyType, Error: "edit id mismatch"}
+	if err := <-errs; err == nil {
+		t.Fatal("Expected error from rejected delete.")
+	}
+}
+
+func TestSendTextLater(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	go room.Run()
+	room.SendTextLater("parent", "Working...", 10*time.Millisecond, func(ctx context.Context) string {
+		time.Sleep(100 * time.Millisecond)
+		return "Done."
+	})
+	packet := <-*th.outbound
+	data, err := GetSendCommandPayload(packet)
+	if err != nil || data.Content != "Working..." || data.Parent != "parent" {
+		t.Fatalf("Expected placeholder reply, got %s packet %s.", packet.Type, packet.Data)
+	}
+	th.SendReply(packet.ID, SendReplyType, Message{ID: "m1",
+		Sender: User{ID: "bot:test", Name: "MaiMai"}, Content: "Working..."})
+	id, edit := th.ReceiveEdit()
+	if edit.ID != "m1" || edit.Content != "Done." {
+		t.Fatalf("Incorrect edit command: %+v", edit)
+	}
+	th.SendReply(id, EditMessageReplyType, EditMessageReply{EditID: "e1",
+		Message: Message{ID: "m1", Sender: User{ID: "bot:test"}, Content: "Done."}})
+
+	room.SendTextLater("parent", "Working...", time.Second, func(ctx context.Context) string {
+		return "Quick."
+	})
+	th.AssertReceivedSendText("Quick.")
+
+	for i := 0; len(room.pending) > 0; i++ {
+		if i == 100 {
+			t.Fatal("Replies still pending after being sent.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	block := make(chan empty)
+	defer close(block)
+	for i := 0; i < maxPendingReplies; i++ {
+		room.SendTextLater("parent", "Working...", time.Minute, func(ctx context.Context) string {
+			<-block
+			return ""
+		})
+	}
+	err = room.SendTextLater("parent", "Working...", time.Minute, func(ctx context.Context) string {
+		return ""
+	})
+	if err == nil {
+		t.Fatal("Expected error with too many replies pending.")
+	}
+}
+
+func TestMessageContext(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	contexts := make(chan *MessageContext, 2)
+	room.AddHandler("test-message", MessageHandler(func(mc *MessageContext) error {
+		contexts <- mc
+		if mc.IsFromSelf() {
+			return nil
+		}
+		mc.Reply("hello " + Mention(mc.Sender().Name))
+		mc.ReplyThreaded("threaded")
+		return nil
+	}))
+	// Each handler is passed its own copy of the message.
+	room.AddHandler("test-mutate", MessageHandler(func(mc *MessageContext) error {
+		mc.Message.Content = "changed"
+		return nil
+	}))
+	go room.Run()
+	th.SendMessage(HelloEventType, HelloEvent{Session: SessionView{
+		User:      User{ID: "bot:test"},
+		SessionID: "test-session"}})
+	th.SendMessage(SendEventType, Message{ID: "m1", Parent: "p1", Content: "hi",
+		Sender: User{ID: "agent:alice", Name: "alice smith"}})
+	mc := <-contexts
+	if mc.Room != room || mc.Message.ID != "m1" || mc.Sender().ID != "agent:alice" || mc.IsFromSelf() {
+		t.Fatalf("Incorrect message context: %+v", mc)
+	}
+	replies := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		data, err := GetSendCommandPayload(<-*th.outbound)
+		if err != nil {
+			t.Fatalf("Could not decode reply: %s", err)
+		}
+		replies[data.Content] = data.Parent
+	}
+	if replies["hello @alicesmith"] != "p1" || replies["threaded"] != "m1" {
+		t.Fatalf("Incorrect replies: %v", replies)
+	}
+	if mc.Message.Content != "hi" {
+		t.Fatalf("Message changed by another handler: %+v", mc.Message)
+	}
+	th.SendMessage(SendEventType, Message{ID: "m2", Content: "hi",
+		Sender: User{ID: "bot:test", Name: "MaiMai"}})
+	select {
+	case <-contexts:
+		t.Fatal("Own message passed to message handler.")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// sessionMessage is a Message with its sender's session, as the server sends
+// it.
+type sessionMessage struct {
+	Message
+	Sender SessionView `json:"sender"`
+}
+
+func TestIgnore(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	room.config.Ignore = []string{"agent:spam", "*bot"}
+	room.config.LoopLimit = 2
+	passed := make(chan string, 16)
+	for _, name := range []string{"test-plain", "test-recording"} {
+		name := name
+		var h HandlerFactory = MessageHandler(func(mc *MessageContext) error {
+			passed <- name
+			return nil
+		})
+		if name == "test-recording" {
+			h = RecordingHandler(h)
+		}
+		room.AddHandler(name, h)
+	}
+	go room.Run()
+	th.SendMessage(HelloEventType, HelloEvent{Session: SessionView{
+		User:      User{ID: "agent:self"},
+		SessionID: "test-session"}})
+	assertIgnored := func(msg interface{}) {
+		th.SendMessage(SendEventType, msg)
+		select {
+		case packet := <-*th.outbound:
+			t.Fatalf("Unexpected %s packet %s in reply to %+v.", packet.Type, packet.Data, msg)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	assertIgnored(sessionMessage{Message{Content: "!ping"},
+		SessionView{User: User{Name: "MaiMai"}, SessionID: "test-session"}})
+	assertIgnored(Message{Content: "!ping", Sender: User{ID: "agent:spam", Name: "spam"}})
+	assertIgnored(Message{Content: "!ping", Sender: User{ID: "agent:other", Name: "Other Bot"}})
+	for i := 0; i < 3; i++ {
+		if name := <-passed; name != "test-recording" {
+			t.Fatalf("Ignored message passed to %s.", name)
+		}
+	}
+	if len(passed) != 0 {
+		t.Fatalf("Ignored message passed to %s.", <-passed)
+	}
+
+	th.SendReply("", SendReplyType, Message{ID: "own1", Content: "hello",
+		Sender: User{ID: "agent:self"}})
+	loop := Message{Content: "!ping", Parent: "own1",
+		Sender: User{ID: "agent:loop", Name: "looper"}}
+	for i := 0; i < 2; i++ {
+		th.SendMessage(SendEventType, loop)
+		th.AssertReceivedSendText("pong!")
+	}
+	assertIgnored(loop)
+	th.SendSendEvent("!ping", "", "human")
+	th.AssertReceivedSendText("pong!")
+}
+
+func TestMentions(t *testing.T) {
+	mentions := ParseMentions("hi @Alice, and @bob! mail x@y.z or @ (@carol)")
+	if strings.Join(mentions, " ") != "Alice bob" {
+		t.Fatalf("Incorrect mentions: %q", mentions)
+	}
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	contexts := make(chan *MessageContext, 4)
+	room.AddHandler("test-message", MessageHandler(func(mc *MessageContext) error {
+		contexts <- mc
+		return nil
+	}))
+	go room.Run()
+	th.SendSendEvent("@maimai seen @alice", "", "test")
+	th.AssertReceivedSendText("User has not been seen yet.")
+	mc := <-contexts
+	if !mc.Addressed || mc.Command != "seen" || len(mc.Args) != 1 || mc.Args[0] != "@alice" {
+		t.Fatalf("Incorrect addressed command: %+v", mc)
+	}
+	th.SendSendEvent("thanks @Mai Mai", "", "test")
+	if mc := <-contexts; mc.Addressed || mc.Command != "" {
+		t.Fatalf("Message not addressed to the bot parsed as addressed: %+v", mc)
+	}
+	th.SendSendEvent("thanks @MaiMai!", "", "test")
+	if mc := <-contexts; mc.Addressed || !mc.MentionsSelf() {
+		t.Fatalf("Mention of the bot not recognized: %+v", mc)
+	}
+	th.SendSendEvent("!seen @alice", "", "test")
+	th.AssertReceivedSendText("User has not been seen yet.")
+	if mc := <-contexts; mc.Addressed || mc.Command != "seen" {
+		t.Fatalf("Incorrect command: %+v", mc)
+	}
+}
+
+func TestBotCommands(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.store.Close()
+	defer room.Stop()
+	room.config.HandlerOptions = map[string]json.RawMessage{
+		"bot-commands": json.RawMessage(`{"help": "Test help."}`)}
+	go room.Run()
+	th.SendSendEvent("!ping", "", "test")
+	th.AssertReceivedSendText("pong!")
+	th.SendSendEvent("!ping @other", "", "test")
+	th.SendSendEvent("!pingpong", "", "test")
+	th.SendSendEvent("!ping @MaiMai", "", "test")
+	th.AssertReceivedSendText("pong!")
+	th.SendSendEvent("!help @maimai", "", "test")
+	th.AssertReceivedSendText("Test help.")
+
+	sentReply := func(text string) {
+		packet := <-*th.outbound
+		data, err := GetSendCommandPayload(packet)
+		if err != nil || data.Content != text {
+			t.Fatalf("Expected reply '%s', got %s packet %s.", text, packet.Type, packet.Data)
+		}
+		th.SendReply(packet.ID, SendReplyType, Message{ID: "r" + packet.ID, Content: text,
+			Sender: User{ID: "bot:test", Name: "MaiMai"}})
+	}
+	th.SendSendEvent("!restart @MaiMai", "", "test")
+	sentReply("/me is restarting.")
+	select {
+	case <-room.sr.(*MockSenderReceiver).reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Not reconnected after !restart.")
+	}
+	th.SendSendEvent("!kill @MaiMai", "", "test")
+	sentReply("/me is exiting.")
+	for i := 0; room.ctx.Err() == nil; i++ {
+		if i == 100 {
+			t.Fatal("Room not stopped after !kill.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := room.SetNick("MaiMai2"); err == nil {
+		t.Fatal("Expected error reconfiguring a killed room.")
+	}
+}
@@ -2,21 +2,34 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cpalone/maimai"
 
 	"github.com/Sirupsen/logrus"
 )
 
+var configPath string
 var roomName string
 var nick string
 var logPath string
 var dbPath string
 var password string
+var email string
+var accountPassword string
+var cookiePath string
 var join bool
 var msgLog bool
+var migrateDryRun bool
+var msgLogMaxAge time.Duration
+var msgLogMaxCount int
+var forgetUser string
 var logger = logrus.New()
 
 func init() {
@@ -29,39 +42,307 @@ func init() {
 		defaultJoin   = false
 		defaultMsgLog = false
 	)
+	flag.StringVar(&configPath, "config", "", "path to a JSON config file describing the rooms to join")
 	flag.StringVar(&roomName, "room", defaultRoom, "room for the bot to join")
 	flag.StringVar(&nick, "nick", defaultNick, "nick for the bot to use")
 	flag.StringVar(&logPath, "log", defaultLog, "path for the bot's log")
 	flag.StringVar(&dbPath, "db", defaultDB, "path for the bot's db")
 	flag.StringVar(&password, "pass", defaultPass, "password for the room")
+	flag.StringVar(&email, "email", "", "email of the account for the bot to log in to")
+	flag.StringVar(&accountPassword, "account-pass", "", "password of the account for the bot to log in to")
+	flag.StringVar(&cookiePath, "cookies", "", "path to keep the bot's cookies in, so it keeps its identity across restarts")
 	flag.BoolVar(&join, "join", defaultJoin, "whether the bot sends join/part/nick messages")
 	flag.BoolVar(&msgLog, "msglog", defaultMsgLog, "whether the bot logs messages.")
+	flag.DurationVar(&msgLogMaxAge, "msglog-max-age", 0, "how long logged messages are kept, 0 to keep forever")
+	flag.IntVar(&msgLogMaxCount, "msglog-max-count", 0, "how many logged messages are kept, 0 to keep all")
+	flag.StringVar(&forgetUser, "forget", "", "remove the messages and seen records of the user with this ID from the db, then exit")
+	flag.BoolVar(&migrateDryRun, "migrate-dryrun", false, "report the db migrations that would run, then exit")
+}
+
+// loadConfig reads the config file if one was given, then overrides its
+// values with any flags set on the command line. Without a config file every
+// flag applies, describing a single room.
+func loadConfig() (*maimai.Config, error) {
+	set := make(map[string]bool)
+	cfg := &maimai.Config{}
+	if configPath != "" {
+		var err error
+		if cfg, err = maimai.LoadConfig(configPath); err != nil {
+			return nil, err
+		}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	} else {
+		flag.VisitAll(func(f *flag.Flag) { set[f.Name] = true })
+	}
+	if set["log"] {
+		cfg.Logging.Path = logPath
+	}
+	if set["room"] {
+		// Only run the named room, with its settings from the file if present.
+		rooms := []maimai.RoomFileConfig{{Room: roomName}}
+		for _, rc := range cfg.Rooms {
+			if rc.Room == roomName {
+				rooms[0] = rc
+			}
+		}
+		cfg.Rooms = rooms
+	}
+	if set["db"] && len(cfg.Rooms) > 1 {
+		return nil, fmt.Errorf("-db cannot be used with more than one room")
+	}
+	for i := range cfg.Rooms {
+		rc := &cfg.Rooms[i]
+		if set["nick"] {
+			rc.Nick = nick
+		}
+		if set["db"] {
+			rc.DBPath = dbPath
+		}
+		if set["pass"] {
+			rc.Password = password
+		}
+		if set["email"] {
+			rc.Email = email
+		}
+		if set["account-pass"] {
+			rc.AccountPassword = accountPassword
+		}
+		if set["cookies"] {
+			rc.CookiePath = cookiePath
+		}
+		if set["join"] {
+			rc.Join = join
+		}
+		if set["msglog"] {
+			rc.MsgLog = msgLog
+		}
+		if set["msglog-max-age"] {
+			rc.MsgLogMaxAge.Duration = msgLogMaxAge
+		}
+		if set["msglog-max-count"] {
+			rc.MsgLogMaxCount = msgLogMaxCount
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.SetDefaults()
+	return cfg, nil
+}
+
+// newLogger returns a logger writing to path, configured as in cfg.
+func newLogger(path string, cfg maimai.LoggingConfig) (*logrus.Logger, *os.File, error) {
+	logFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	l := logrus.New()
+	l.Out = logFile
+	l.Level, _ = logrus.ParseLevel(cfg.Level)
+	if cfg.Format == "text" {
+		l.Formatter = &logrus.TextFormatter{}
+	} else {
+		l.Formatter = &logrus.JSONFormatter{}
+	}
+	return l, logFile, nil
 }
 
 func main() {
 	flag.Parse()
 
-	logFile, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if migrateDryRun {
+		for _, rc := range cfg.Rooms {
+			store, err := maimai.NewBoltStore(rc.DBPath)
+			if err != nil {
+				panic(err)
+			}
+			report, err := maimai.Migrate(store, true)
+			store.Close()
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("%s: %s\n", rc.DBPath, report)
+		}
+		return
+	}
+
+	if forgetUser != "" {
+		for _, rc := range cfg.Rooms {
+			store, err := maimai.NewBoltStore(rc.DBPath)
+			if err != nil {
+				panic(err)
+			}
+			msgs, seen, err := store.ForgetUser(forgetUser)
+			store.Close()
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("%s: removed %d messages and %d seen records.\n", rc.DBPath, msgs, seen)
+		}
+		return
+	}
+
+	var logFile *os.File
+	logger, logFile, err = newLogger(cfg.Logging.Path, cfg.Logging)
 	if err != nil {
 		panic(err)
 	}
 	defer logFile.Close()
-	logger.Out = logFile
-	logger.Level = logrus.DebugLevel
-	logger.Formatter = &logrus.JSONFormatter{}
 
 	runtime.GOMAXPROCS(runtime.NumCPU() - 1)
-	roomCfg := &maimai.RoomConfig{
-		DBPath:       dbPath,
-		ErrorLogPath: logPath,
-		Join:         join,
-		MsgLog:       msgLog,
-		Nick:         nick,
-		Password:     password,
-	}
-	room, err := maimai.NewRoom(roomCfg, roomName, maimai.NewWSSenderReceiver(roomName, logger), logger)
+	var wg sync.WaitGroup
+	rooms := make(map[string]*maimai.Room)
+	for _, rc := range cfg.Rooms {
+		room, err := startRoom(cfg, rc, &wg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not start room %s: %s\n", rc.Room, err)
+			os.Exit(1)
+		}
+		rooms[rc.Room] = room
+	}
+
+	// The bot keeps running when all its rooms have stopped, so that they can
+	// be started again on SIGHUP, until it is interrupted or terminated.
+	// Rooms are only started and stopped here, so wg.Add never races wg.Wait.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			reload(rooms, &wg)
+			continue
+		}
+		logger.Infof("Received %s, stopping rooms.", sig)
+		for _, room := range rooms {
+			room.Stop()
+		}
+		break
+	}
+	wg.Wait()
+}
+
+// cookieFiles holds the cookie files in use, so that rooms sharing one share
+// its CookieFile.
+var cookieFiles = make(map[string]*maimai.CookieFile)
+
+func cookieFile(path string) (*maimai.CookieFile, error) {
+	if cf, ok := cookieFiles[path]; ok {
+		return cf, nil
+	}
+	cf, err := maimai.LoadCookieFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	cookieFiles[path] = cf
+	return cf, nil
+}
+
+// startRoom creates and runs a room, whose config is reloaded from the config
+// file when requested by an admin. The room's log file, if it has its own, is
+// closed once it has stopped.
+func startRoom(cfg *maimai.Config, rc maimai.RoomFileConfig, wg *sync.WaitGroup) (*maimai.Room, error) {
+	roomLogger := logger
+	var logFile *os.File
+	if rc.LogPath != "" {
+		var err error
+		roomLogger, logFile, err = newLogger(rc.LogPath, cfg.Logging)
+		if err != nil {
+			return nil, err
+		}
+	}
+	closeLog := func() {
+		if logFile != nil {
+			logFile.Close()
+		}
+	}
+	cookies, err := cookieFile(rc.CookiePath)
+	if err != nil {
+		closeLog()
+		return nil, err
+	}
+	sr := maimai.NewWSSenderReceiver(rc.Room, roomLogger)
+	sr.Host = cfg.Transport.Host
+	sr.ConnectRetries = cfg.Transport.ConnectRetries
+	sr.RetryDelay = cfg.Transport.RetryDelay.Duration
+	sr.Cookies = cookies
+	room, err := maimai.NewRoom(rc.RoomConfig(), rc.Room, sr, roomLogger)
+	if err != nil {
+		closeLog()
+		return nil, err
+	}
+	name := rc.Room
+	room.SetConfigLoader(func() (*maimai.RoomConfig, error) {
+		cfg, err := loadConfig()
+		if err != nil {
+			return nil, err
+		}
+		for _, rc := range cfg.Rooms {
+			if rc.Room == name {
+				return rc.RoomConfig(), nil
+			}
+		}
+		return nil, fmt.Errorf("room %s is no longer configured", name)
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		room.Run()
+		// Run returns while the room is stopping; wait for it to finish.
+		room.Stop()
+		closeLog()
+		if err := room.Err(); err != nil {
+			logger.Errorf("Room %s stopped: %s", name, err)
+		}
+	}()
+	return room, nil
+}
+
+// reload rereads the config file on SIGHUP, reconfiguring running rooms,
+// starting newly configured rooms and those that have stopped, and stopping
+// those no longer configured.
+func reload(rooms map[string]*maimai.Room, wg *sync.WaitGroup) {
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Errorf("Not reloading, invalid config: %s", err)
+		return
+	}
+	configured := make(map[string]bool)
+	for _, rc := range cfg.Rooms {
+		configured[rc.Room] = true
+		room, ok := rooms[rc.Room]
+		if ok && room.Stopped() {
+			// Wait for the room to finish stopping, releasing its db.
+			room.Stop()
+			delete(rooms, rc.Room)
+			ok = false
+		}
+		if !ok {
+			logger.Infof("Reload: starting room %s.", rc.Room)
+			room, err := startRoom(cfg, rc, wg)
+			if err != nil {
+				logger.Errorf("Reload: could not start room %s: %s", rc.Room, err)
+				continue
+			}
+			rooms[rc.Room] = room
+			continue
+		}
+		report, err := room.Reconfigure(rc.RoomConfig())
+		if err != nil {
+			logger.Errorf("Reload: could not reconfigure room %s: %s", rc.Room, err)
+			continue
+		}
+		logger.Infof("Reload: room %s: %s", rc.Room, report)
+	}
+	for name, room := range rooms {
+		if !configured[name] {
+			logger.Infof("Reload: stopping room %s.", name)
+			room.Stop()
+			delete(rooms, name)
+		}
 	}
-	room.Run()
 }
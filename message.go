@@ -0,0 +1,153 @@
+package maimai
+
+import (
+	"context"
+	"strings"
+)
+
+// MessageHandler describes functions that handle the messages sent to the
+// room, one at a time. Errors they return are logged.
+type MessageHandler func(mc *MessageContext) error
+
+// MessageContext is a message sent to the room, as passed to a
+// MessageHandler, with helpers for replying to it.
+type MessageContext struct {
+	Room    *Room
+	Message *Message
+
+	// Command and Args are the command the message gives and its arguments,
+	// for messages such as "!seen @alice" or, addressed to the bot,
+	// "@MaiMai seen @alice". Command is empty for other messages.
+	Command string
+	Args    []string
+	// Addressed is true if the message begins by mentioning the bot.
+	Addressed bool
+
+	// sessionID is the sender's session.
+	sessionID string
+}
+
+// newMessageContext parses msg, sent to room.
+func newMessageContext(room *Room, msg *Message) *MessageContext {
+	mc := &MessageContext{Room: room, Message: msg}
+	fields := strings.Fields(msg.Content)
+	if len(fields) == 0 {
+		return mc
+	}
+	if nick, ok := parseMention(fields[0]); ok && room.isSelfNick(nick) {
+		mc.Addressed = true
+		fields = fields[1:]
+		if len(fields) > 0 {
+			mc.Command = strings.TrimPrefix(fields[0], "!")
+			mc.Args = fields[1:]
+		}
+	} else if len(fields[0]) > 1 && fields[0][0] == '!' {
+		mc.Command = fields[0][1:]
+		mc.Args = fields[1:]
+	}
+	return mc
+}
+
+// Sender returns the user who sent the message.
+func (mc *MessageContext) Sender() User {
+	return mc.Message.Sender
+}
+
+// IsFromSelf returns true if the message was sent by the bot, from this or
+// any other of its sessions.
+func (mc *MessageContext) IsFromSelf() bool {
+	return mc.Room.isSelf(mc.sessionID, mc.Message.Sender)
+}
+
+// Reply sends text in the thread the message is in, alongside it.
+func (mc *MessageContext) Reply(text string) {
+	mc.Room.SendText(text, mc.Message.Parent)
+}
+
+// ReplyThreaded sends text as a reply to the message itself.
+func (mc *MessageContext) ReplyThreaded(text string) {
+	mc.Room.SendText(text, mc.Message.ID)
+}
+
+// Mentions returns the nicks mentioned in the message.
+func (mc *MessageContext) Mentions() []string {
+	return ParseMentions(mc.Message.Content)
+}
+
+// MentionsSelf returns true if the message mentions the bot anywhere.
+func (mc *MessageContext) MentionsSelf() bool {
+	for _, nick := range mc.Mentions() {
+		if mc.Room.isSelfNick(nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageHandlerAdapter is a PacketHandler calling a MessageHandler with each
+// send-event.
+type messageHandlerAdapter struct {
+	h    MessageHandler
+	room *Room
+}
+
+// NewHandler returns a PacketHandler calling h with each message.
+func (h MessageHandler) NewHandler() PacketHandler {
+	return &messageHandlerAdapter{h: h}
+}
+
+func (a *messageHandlerAdapter) Init(room *Room) error {
+	a.room = room
+	return nil
+}
+
+func (a *messageHandlerAdapter) HandlePacket(ctx context.Context, packet *PacketEvent) error {
+	if packet.Type != SendEventType {
+		return nil
+	}
+	data, err := GetMessagePayload(packet)
+	if err != nil {
+		return err
+	}
+	// The decoded payload is shared by every handler of the packet.
+	msg := *data
+	mc := newMessageContext(a.room, &msg)
+	mc.sessionID = packet.senderSession
+	return a.h(mc)
+}
+
+func (a *messageHandlerAdapter) Close() error {
+	return nil
+}
+
+// ParseMentions returns the nicks mentioned in a message, in the order they
+// appear. As in euphoria's client, a mention is an @ at the start of a word
+// followed by the nick, which ends at a space or trailing punctuation.
+func ParseMentions(content string) []string {
+	var nicks []string
+	for _, word := range strings.Fields(content) {
+		if nick, ok := parseMention(word); ok {
+			nicks = append(nicks, nick)
+		}
+	}
+	return nicks
+}
+
+// Mention returns the text that mentions the user with the given nick in a
+// message, notifying them.
+func Mention(nick string) string {
+	return "@" + strings.Join(strings.Fields(nick), "")
+}
+
+// parseMention returns the nick mentioned by a word, if it is a mention.
+func parseMention(word string) (string, bool) {
+	if !strings.HasPrefix(word, "@") {
+		return "", false
+	}
+	nick := strings.TrimRight(word[1:], mentionTrailing)
+	return nick, nick != ""
+}
+
+// mentionTrailing is the punctuation not counted as part of a mentioned nick
+// when it ends one.
+const mentionTrailing = ".,!?;:'\")"
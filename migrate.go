@@ -0,0 +1,161 @@
+package maimai
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// metaBucket holds data about the store itself rather than the room.
+const metaBucket = "Meta"
+
+var schemaVersionKey = []byte("SchemaVersion")
+
+// errDryRun rolls back the transaction of a dry run migration.
+var errDryRun = errors.New("Dry run.")
+
+// migration upgrades a store from the schema version before Version to Version.
+type migration struct {
+	Version     int
+	Description string
+	// Apply makes the migration's changes and returns a description of each.
+	Apply func(tx Tx) ([]string, error)
+}
+
+// migrations lists every change made to the layout or encoding of stored
+// data, oldest first. Any change to either must add a migration to the end
+// of this list, even if existing data needs no conversion, so that older
+// code refuses to open a store it does not understand.
+var migrations = []migration{
+	{1, "Create Seen and MsgLog buckets.", migrateCreateBuckets},
+}
+
+// SchemaVersion is the version of the store layout this package reads and writes.
+var SchemaVersion = migrations[len(migrations)-1].Version
+
+// Version 1 is the layout used before schema versions were recorded: seen
+// times as decimal unix seconds keyed by nick and the message log as JSON
+// encoded MsgLogEvents keyed by message ID. Stores from then have no version
+// but already have both buckets.
+func migrateCreateBuckets(tx Tx) ([]string, error) {
+	var changes []string
+	for _, name := range []string{seenBucket, msgLogBucket} {
+		if tx.HasBucket(name) {
+			continue
+		}
+		if _, err := tx.Bucket(name); err != nil {
+			return nil, fmt.Errorf("Error creating bucket '%s': %s", name, err)
+		}
+		changes = append(changes, fmt.Sprintf("Created bucket '%s'.", name))
+	}
+	return changes, nil
+}
+
+// MigrationReport describes the migrations applied to a store, or that would
+// be applied in a dry run.
+type MigrationReport struct {
+	From    int
+	To      int
+	DryRun  bool
+	Changes []string
+}
+
+func (mr *MigrationReport) String() string {
+	if mr.From == mr.To {
+		return fmt.Sprintf("Schema is up to date at version %d.", mr.To)
+	}
+	verb := "Migrated"
+	if mr.DryRun {
+		verb = "Would migrate"
+	}
+	lines := []string{fmt.Sprintf("%s schema from version %d to %d.", verb, mr.From, mr.To)}
+	for _, change := range mr.Changes {
+		lines = append(lines, "  "+change)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func readSchemaVersion(tx Tx) (int, error) {
+	if !tx.HasBucket(metaBucket) {
+		return 0, nil
+	}
+	b, err := tx.Bucket(metaBucket)
+	if err != nil {
+		return 0, err
+	}
+	data := b.Get(schemaVersionKey)
+	if data == nil {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid schema version '%s': %s", data, err)
+	}
+	return version, nil
+}
+
+// StoredSchemaVersion returns the schema version recorded in store, which is
+// 0 for a new store or one created before versions were recorded.
+func StoredSchemaVersion(store Store) (int, error) {
+	var version int
+	err := store.View(func(tx Tx) error {
+		var err error
+		version, err = readSchemaVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+// Migrate applies, in order and in a single transaction, every migration
+// newer than the schema version recorded in store. If dryRun is true the
+// changes are rolled back, and the report describes what would have changed.
+func Migrate(store Store, dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{To: SchemaVersion, DryRun: dryRun}
+	err := store.Update(func(tx Tx) error {
+		version, err := readSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		report.From = version
+		if version > SchemaVersion {
+			return fmt.Errorf("Store schema version %d is newer than supported version %d.",
+				version, SchemaVersion)
+		}
+		if version == SchemaVersion {
+			return nil
+		}
+		for _, m := range migrations {
+			if m.Version <= version {
+				continue
+			}
+			changes, err := m.Apply(tx)
+			if err != nil {
+				return fmt.Errorf("Error in migration %d: %s", m.Version, err)
+			}
+			report.Changes = append(report.Changes,
+				fmt.Sprintf("%d: %s", m.Version, m.Description))
+			for _, change := range changes {
+				report.Changes = append(report.Changes, "  "+change)
+			}
+		}
+		b, err := tx.Bucket(metaBucket)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(schemaVersionKey, []byte(strconv.Itoa(SchemaVersion))); err != nil {
+			return err
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
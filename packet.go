@@ -3,6 +3,7 @@ package maimai
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 )
 
 // PacketType indicates the type of a packet's payload.
@@ -14,6 +15,23 @@ type PacketEvent struct {
 	Type  PacketType      `json:"type"`
 	Data  json.RawMessage `json:"data,omitempty"`
 	Error string          `json:"error,omitempty"`
+
+	// payload is Data decoded by ValidatePacket. Copies of the packet share
+	// it, so it must not be modified.
+	payload interface{}
+	// ignored is set by the room on messages handlers should not respond to,
+	// and senderSession to the session ID of a send-event's sender, which
+	// Message does not keep.
+	ignored       bool
+	senderSession string
+}
+
+// Ignored returns true for messages handlers should not respond to: those
+// sent by the bot, by users the room ignores, and by senders replying to the
+// bot so often that they are likely another bot caught in a loop with it.
+// They are only passed to handlers registered with RecordingHandler.
+func (p *PacketEvent) Ignored() bool {
+	return p.ignored
 }
 
 // Message is a unit of data associated with a text message sent on the service.
@@ -45,6 +63,8 @@ type User struct {
 	Name      string `json:"name"`
 	ServerID  string `json:"server_id"`
 	ServerEra string `json:"server_era"`
+	IsManager bool   `json:"is_manager,omitempty"`
+	IsStaff   bool   `json:"is_staff,omitempty"`
 }
 
 type SendCommand struct {
@@ -70,6 +90,11 @@ type AuthCommand struct {
 	Passcode string `json:"passcode,omitempty"`
 }
 
+type AuthReply struct {
+	Success bool   `json:"success"`
+	Reason  string `json:"reason,omitempty"`
+}
+
 type PresenceEvent struct {
 	*User
 	SessionID string `json:"session_id"`
@@ -82,6 +107,116 @@ type BounceEvent struct {
 	IP          string   `json:"ip,omitempty"`
 }
 
+// LogCommand requests up to N messages from the room's log, optionally only
+// those sent before the message with ID Before.
+type LogCommand struct {
+	N      int    `json:"n"`
+	Before string `json:"before,omitempty"`
+}
+
+// LogReply contains a page of the room's log, oldest message first.
+type LogReply struct {
+	Log    []Message `json:"log"`
+	Before string    `json:"before,omitempty"`
+}
+
+// EditMessageEvent indicates that a message in the room has been edited or
+// deleted. The embedded Message holds its new state.
+type EditMessageEvent struct {
+	EditID string `json:"edit_id"`
+	Message
+}
+
+// EditMessageCommand edits or deletes a message. PreviousEditID must be the
+// ID of the message's latest edit, or empty if it has not been edited.
+// Announce sends an edit-message-event to the room.
+type EditMessageCommand struct {
+	ID             string `json:"id"`
+	PreviousEditID string `json:"previous_edit_id"`
+	Content        string `json:"content,omitempty"`
+	Delete         bool   `json:"delete,omitempty"`
+	Announce       bool   `json:"announce"`
+}
+
+type EditMessageReply EditMessageEvent
+
+// Account describes the account a session is logged in to.
+type Account struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+}
+
+// SessionView describes a session in the room.
+type SessionView struct {
+	User
+	SessionID string `json:"session_id"`
+}
+
+// HelloEvent is sent by the server on connecting. Account is nil if the
+// session is not logged in.
+type HelloEvent struct {
+	ID               string      `json:"id"`
+	Account          *Account    `json:"account,omitempty"`
+	Session          SessionView `json:"session"`
+	AccountHasAccess bool        `json:"account_has_access,omitempty"`
+	RoomIsPrivate    bool        `json:"room_is_private"`
+	Version          string      `json:"version"`
+}
+
+// SnapshotEvent is sent by the server once the session has entered the room,
+// listing the other sessions present and the most recent messages.
+type SnapshotEvent struct {
+	Identity  string        `json:"identity"`
+	SessionID string        `json:"session_id"`
+	Version   string        `json:"version"`
+	Listing   []SessionView `json:"listing"`
+	Nick      string        `json:"nick,omitempty"`
+	Log       []Message     `json:"log"`
+}
+
+// ReadyEvent is the payload of the ready-event the room passes to handlers
+// once a connection is set up: the bot has entered the room and sent its
+// nick. Session is the bot's session as given by the hello-event.
+type ReadyEvent struct {
+	Session SessionView `json:"session"`
+	Account *Account    `json:"account,omitempty"`
+}
+
+// LoginCommand logs the session's agent in to an account. The server
+// disconnects after a successful login, and the agent is logged in on
+// reconnecting with the same cookie.
+type LoginCommand struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+	Password  string `json:"password"`
+}
+
+type LoginReply struct {
+	Success   bool   `json:"success"`
+	Reason    string `json:"reason,omitempty"`
+	AccountID string `json:"account_id,omitempty"`
+}
+
+// PMInitiateCommand invites the user with the given ID to a private message
+// room. The reply gives the room's ID.
+type PMInitiateCommand struct {
+	UserID string `json:"user_id"`
+}
+
+type PMInitiateReply struct {
+	PMID   string `json:"pm_id"`
+	ToNick string `json:"to_nick"`
+}
+
+// PMInitiateEvent is sent to a user invited to a private message room.
+type PMInitiateEvent struct {
+	From     string `json:"from"`
+	FromNick string `json:"from_nick"`
+	FromRoom string `json:"from_room"`
+	PMID     string `json:"pm_id"`
+}
+
 // SendEvent is a packet type that contains a Message only.
 type SendEvent Message
 
@@ -104,38 +239,132 @@ const (
 
 	PartEventType = "part-event"
 
-	AuthType = "auth"
+	AuthType      = "auth"
+	AuthReplyType = "auth-reply"
 
 	BounceEventType = "bounce-event"
+
+	LogType      = "log"
+	LogReplyType = "log-reply"
+
+	EditMessageType      = "edit-message"
+	EditMessageReplyType = "edit-message-reply"
+	EditMessageEventType = "edit-message-event"
+
+	HelloEventType    = "hello-event"
+	SnapshotEventType = "snapshot-event"
+
+	// ReadyEventType packets are not sent by the server but passed to
+	// handlers by the room once a connection is set up.
+	ReadyEventType = "ready-event"
+
+	LoginType      = "login"
+	LoginReplyType = "login-reply"
+
+	PMInitiateType      = "pm-initiate"
+	PMInitiateReplyType = "pm-initiate-reply"
+	PMInitiateEventType = "pm-initiate-event"
 )
 
-// Payload unmarshals the packet payload into the proper Event type and returns it.
-func (p *PacketEvent) Payload() (interface{}, error) {
-	var payload interface{}
-	switch p.Type {
+// newPayload returns a pointer to a new value of the type carried by packets
+// of the given type, or nil if the type is not known.
+func newPayload(pType PacketType) interface{} {
+	switch pType {
 	case PingEventType:
-		payload = &PingEvent{}
+		return &PingEvent{}
 	case SendEventType, SendReplyType:
-		payload = &Message{}
+		return &Message{}
 	case SendType:
-		payload = &SendCommand{}
+		return &SendCommand{}
+	case NickType:
+		return &NickCommand{}
+	case NickReplyType:
+		return &NickReply{}
 	case NickEventType:
-		payload = &NickEvent{}
+		return &NickEvent{}
 	case JoinEventType, PartEventType:
-		payload = &PresenceEvent{}
+		return &PresenceEvent{}
 	case PingReplyType:
-		payload = &PingReply{}
+		return &PingReply{}
 	case AuthType:
-		payload = &AuthCommand{}
+		return &AuthCommand{}
+	case AuthReplyType:
+		return &AuthReply{}
 	case BounceEventType:
-		payload = &BounceEvent{}
-	default:
+		return &BounceEvent{}
+	case LogType:
+		return &LogCommand{}
+	case LogReplyType:
+		return &LogReply{}
+	case EditMessageType:
+		return &EditMessageCommand{}
+	case EditMessageReplyType:
+		return &EditMessageReply{}
+	case EditMessageEventType:
+		return &EditMessageEvent{}
+	case HelloEventType:
+		return &HelloEvent{}
+	case SnapshotEventType:
+		return &SnapshotEvent{}
+	case ReadyEventType:
+		return &ReadyEvent{}
+	case LoginType:
+		return &LoginCommand{}
+	case LoginReplyType:
+		return &LoginReply{}
+	case PMInitiateType:
+		return &PMInitiateCommand{}
+	case PMInitiateReplyType:
+		return &PMInitiateReply{}
+	case PMInitiateEventType:
+		return &PMInitiateEvent{}
+	}
+	return nil
+}
+
+// Payload unmarshals the packet payload into the proper Event type and returns
+// it. Inbound packets are decoded once, before they are passed to handlers,
+// and every handler is returned the same value, which must not be modified.
+func (p *PacketEvent) Payload() (interface{}, error) {
+	if p.payload != nil {
+		return p.payload, nil
+	}
+	payload := newPayload(p.Type)
+	if payload == nil {
 		return p.Data, errors.New("Unexpected packet type.")
 	}
-	err := json.Unmarshal(p.Data, &payload)
+	err := json.Unmarshal(p.Data, payload)
 	return payload, err
 }
 
+// PayloadTypeError is returned when a packet's payload is requested as a type
+// other than the one carried by packets of its Type.
+type PayloadTypeError struct {
+	PacketType PacketType
+	Requested  string
+}
+
+func (e *PayloadTypeError) Error() string {
+	return fmt.Sprintf("Packet of type '%s' does not have a %s payload.", e.PacketType, e.Requested)
+}
+
+// DecodePayload decodes the packet's payload as a T. It returns a
+// *PayloadTypeError, without decoding, if packets of the packet's Type do not
+// carry a T. As with Payload, the payloads of inbound packets are shared.
+func DecodePayload[T any](packet *PacketEvent) (*T, error) {
+	if payload, ok := packet.payload.(*T); ok {
+		return payload, nil
+	}
+	payload, ok := newPayload(packet.Type).(*T)
+	if !ok {
+		return nil, &PayloadTypeError{packet.Type, fmt.Sprintf("%T", payload)}
+	}
+	if err := json.Unmarshal(packet.Data, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
 func MakePacket(ID string, msgType PacketType, payload interface{}) (*PacketEvent, error) {
 	packet := &PacketEvent{
 		ID:   ID,
@@ -150,29 +379,110 @@ func MakePacket(ID string, msgType PacketType, payload interface{}) (*PacketEven
 	return packet, nil
 }
 
-func GetMessagePayload(packet *PacketEvent) *Message {
-	payload, _ := packet.Payload()
-	se, ok := payload.(*Message)
-	if !ok {
+// The following accessors decode the payload of packets of the types named,
+// as DecodePayload does.
 
-	}
-	return se
+// GetMessagePayload decodes the payload of a send-event or send-reply packet.
+func GetMessagePayload(packet *PacketEvent) (*Message, error) {
+	return DecodePayload[Message](packet)
 }
 
-func GetNickEventPayload(packet *PacketEvent) *NickEvent {
-	payload, _ := packet.Payload()
-	se, ok := payload.(*NickEvent)
-	if !ok {
-		panic("Failed to assert payload as *NickEvent")
-	}
-	return se
+// GetSendCommandPayload decodes the payload of a send packet.
+func GetSendCommandPayload(packet *PacketEvent) (*SendCommand, error) {
+	return DecodePayload[SendCommand](packet)
 }
 
-func GetPresenceEventPayload(packet *PacketEvent) *PresenceEvent {
-	payload, _ := packet.Payload()
-	se, ok := payload.(*PresenceEvent)
-	if !ok {
-		panic("Failed to assert payload as *PresenceEvent")
-	}
-	return se
+// GetPingEventPayload decodes the payload of a ping-event packet.
+func GetPingEventPayload(packet *PacketEvent) (*PingEvent, error) {
+	return DecodePayload[PingEvent](packet)
+}
+
+// GetPingReplyPayload decodes the payload of a ping-reply packet.
+func GetPingReplyPayload(packet *PacketEvent) (*PingReply, error) {
+	return DecodePayload[PingReply](packet)
+}
+
+// GetNickCommandPayload decodes the payload of a nick packet.
+func GetNickCommandPayload(packet *PacketEvent) (*NickCommand, error) {
+	return DecodePayload[NickCommand](packet)
+}
+
+// GetNickReplyPayload decodes the payload of a nick-reply packet.
+func GetNickReplyPayload(packet *PacketEvent) (*NickReply, error) {
+	return DecodePayload[NickReply](packet)
+}
+
+// GetNickEventPayload decodes the payload of a nick-event packet.
+func GetNickEventPayload(packet *PacketEvent) (*NickEvent, error) {
+	return DecodePayload[NickEvent](packet)
+}
+
+// GetPresenceEventPayload decodes the payload of a join-event or part-event packet.
+func GetPresenceEventPayload(packet *PacketEvent) (*PresenceEvent, error) {
+	return DecodePayload[PresenceEvent](packet)
+}
+
+// GetAuthCommandPayload decodes the payload of an auth packet.
+func GetAuthCommandPayload(packet *PacketEvent) (*AuthCommand, error) {
+	return DecodePayload[AuthCommand](packet)
+}
+
+// GetAuthReplyPayload decodes the payload of an auth-reply packet.
+func GetAuthReplyPayload(packet *PacketEvent) (*AuthReply, error) {
+	return DecodePayload[AuthReply](packet)
+}
+
+// GetBounceEventPayload decodes the payload of a bounce-event packet.
+func GetBounceEventPayload(packet *PacketEvent) (*BounceEvent, error) {
+	return DecodePayload[BounceEvent](packet)
+}
+
+// GetLogCommandPayload decodes the payload of a log packet.
+func GetLogCommandPayload(packet *PacketEvent) (*LogCommand, error) {
+	return DecodePayload[LogCommand](packet)
+}
+
+// GetLogReplyPayload decodes the payload of a log-reply packet.
+func GetLogReplyPayload(packet *PacketEvent) (*LogReply, error) {
+	return DecodePayload[LogReply](packet)
+}
+
+// GetEditMessageEventPayload decodes the payload of an edit-message-event packet.
+func GetEditMessageEventPayload(packet *PacketEvent) (*EditMessageEvent, error) {
+	return DecodePayload[EditMessageEvent](packet)
+}
+
+// GetEditMessageReplyPayload decodes the payload of an edit-message-reply packet.
+func GetEditMessageReplyPayload(packet *PacketEvent) (*EditMessageReply, error) {
+	return DecodePayload[EditMessageReply](packet)
+}
+
+// GetHelloEventPayload decodes the payload of a hello-event packet.
+func GetHelloEventPayload(packet *PacketEvent) (*HelloEvent, error) {
+	return DecodePayload[HelloEvent](packet)
+}
+
+// GetSnapshotEventPayload decodes the payload of a snapshot-event packet.
+func GetSnapshotEventPayload(packet *PacketEvent) (*SnapshotEvent, error) {
+	return DecodePayload[SnapshotEvent](packet)
+}
+
+// GetReadyEventPayload decodes the payload of a ready-event packet.
+func GetReadyEventPayload(packet *PacketEvent) (*ReadyEvent, error) {
+	return DecodePayload[ReadyEvent](packet)
+}
+
+// GetLoginReplyPayload decodes the payload of a login-reply packet.
+func GetLoginReplyPayload(packet *PacketEvent) (*LoginReply, error) {
+	return DecodePayload[LoginReply](packet)
+}
+
+// GetPMInitiateReplyPayload decodes the payload of a pm-initiate-reply packet.
+func GetPMInitiateReplyPayload(packet *PacketEvent) (*PMInitiateReply, error) {
+	return DecodePayload[PMInitiateReply](packet)
+}
+
+// GetPMInitiateEventPayload decodes the payload of a pm-initiate-event packet.
+func GetPMInitiateEventPayload(packet *PacketEvent) (*PMInitiateEvent, error) {
+	return DecodePayload[PMInitiateEvent](packet)
 }
@@ -0,0 +1,128 @@
+package maimai
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultPMHandlers are the handlers run in private message rooms if the
+// room's PMHandlers is empty.
+var defaultPMHandlers = []string{"ping-event", "bot-commands", "seen-command",
+	"uptime-command", "admin"}
+
+// Defaults for RoomConfig.MaxPMs and PMIdleTimeout.
+const (
+	defaultMaxPMs        = 10
+	defaultPMIdleTimeout = 30 * time.Minute
+)
+
+// InitiatePM invites the user with the given ID to a private message room
+// with the bot. The pm handler opens the room once the server replies.
+func (r *Room) InitiatePM(userID string) {
+	payload := PMInitiateCommand{UserID: userID}
+	r.sendPayload(payload, PMInitiateType)
+}
+
+// OpenPM connects to the private message room with the given ID and runs it
+// until r is stopped or nothing has been said in it for the room's
+// PMIdleTimeout, returning it. A room already open is returned as is, and an
+// error is returned if the room's MaxPMs are already open.
+//
+// PM rooms run the room's PMHandlers with its options and share its store,
+// so that commands like !seen can be used privately, but keep no message log.
+func (r *Room) OpenPM(pmID string) (*Room, error) {
+	r.pmMu.Lock()
+	defer r.pmMu.Unlock()
+	if r.ctx.Err() != nil {
+		return nil, errors.New("Room is stopped.")
+	}
+	if pm, ok := r.pms[pmID]; ok {
+		return pm, nil
+	}
+	cfg := *r.roomConfig()
+	limit := cfg.MaxPMs
+	if limit == 0 {
+		limit = defaultMaxPMs
+	}
+	if len(r.pms) >= limit {
+		return nil, fmt.Errorf("Too many PMs open (%d), not opening PM %s.", len(r.pms), pmID)
+	}
+	timeout := cfg.PMIdleTimeout
+	if timeout == 0 {
+		timeout = defaultPMIdleTimeout
+	}
+	cfg.Handlers = cfg.PMHandlers
+	if len(cfg.Handlers) == 0 {
+		cfg.Handlers = defaultPMHandlers
+	}
+	cfg.Join = false
+	cfg.MsgLog = false
+	cfg.MsgLogMaxAge = 0
+	cfg.MsgLogMaxCount = 0
+	cfg.Password = ""
+	pm, err := NewRoomWithStore(&cfg, "pm:"+pmID, r.sr.openPM(pmID), r.store, r.Logger)
+	if err != nil {
+		return nil, err
+	}
+	pm.parent = r
+	pm.data.lastMessage = time.Now()
+	r.pms[pmID] = pm
+	r.Logger.Infof("Opened PM %s.", pmID)
+	go pm.closeWhenIdle(pmID, timeout)
+	go func() {
+		pm.Run()
+		r.pmMu.Lock()
+		delete(r.pms, pmID)
+		r.pmMu.Unlock()
+	}()
+	return pm, nil
+}
+
+// closeWhenIdle stops the private message room with the given ID once nothing
+// has been said in it for timeout.
+func (r *Room) closeWhenIdle(pmID string, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			r.data.Lock()
+			idle := time.Since(r.data.lastMessage)
+			r.data.Unlock()
+			if idle >= timeout {
+				r.Logger.Infof("Closing PM %s, idle for %s.", pmID, idle)
+				r.Stop()
+				return
+			}
+			timer.Reset(timeout - idle)
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+// PMs returns the private message rooms open, by ID.
+func (r *Room) PMs() map[string]*Room {
+	r.pmMu.Lock()
+	defer r.pmMu.Unlock()
+	pms := make(map[string]*Room, len(r.pms))
+	for id, pm := range r.pms {
+		pms[id] = pm
+	}
+	return pms
+}
+
+// Parent returns the room a private message room was opened from, or nil if
+// r is not one.
+func (r *Room) Parent() *Room {
+	return r.parent
+}
+
+// stopPMs stops the private message rooms open. The room must be stopped
+// first, so that no more are opened.
+func (r *Room) stopPMs() {
+	for _, pm := range r.PMs() {
+		pm.Stop()
+	}
+}
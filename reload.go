@@ -0,0 +1,251 @@
+package maimai
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ConfigLoader returns the current configuration for a room, such as by
+// reading it again from a config file. It is used by Room.Reload.
+type ConfigLoader func() (*RoomConfig, error)
+
+// ReloadReport describes the changes made by reconfiguring a room. Changes
+// that cannot be applied without restarting the room are listed in Skipped.
+type ReloadReport struct {
+	Applied []string
+	Skipped []string
+}
+
+func (rr *ReloadReport) String() string {
+	if len(rr.Applied) == 0 && len(rr.Skipped) == 0 {
+		return "No changes."
+	}
+	var lines []string
+	for _, change := range rr.Applied {
+		lines = append(lines, "Applied: "+change)
+	}
+	for _, change := range rr.Skipped {
+		lines = append(lines, "Needs restart: "+change)
+	}
+	return strings.Join(lines, "\n")
+}
+
+type reconfigRequest struct {
+	cfg      *RoomConfig
+	handlers []namedHandler
+	// control, if not nil, is sent to the handler named by target instead
+	// of applying cfg.
+	target  string
+	control *Control
+	report  chan *ReloadReport
+}
+
+// SetConfigLoader sets the function Reload gets the room's new config from.
+func (r *Room) SetConfigLoader(loader ConfigLoader) {
+	r.configMu.Lock()
+	r.loader = loader
+	r.configMu.Unlock()
+}
+
+// roomConfig returns the room's current config, which must not be modified.
+func (r *Room) roomConfig() *RoomConfig {
+	r.configMu.RLock()
+	defer r.configMu.RUnlock()
+	return r.config
+}
+
+// Reload gets a new config for the room from its ConfigLoader and applies it
+// with Reconfigure.
+func (r *Room) Reload() (*ReloadReport, error) {
+	r.configMu.RLock()
+	loader := r.loader
+	r.configMu.RUnlock()
+	if loader == nil {
+		return nil, errors.New("No config loader set.")
+	}
+	cfg, err := loader()
+	if err != nil {
+		return nil, err
+	}
+	return r.Reconfigure(cfg)
+}
+
+// Reconfigure applies cfg to the running room without reconnecting: handlers
+// enabled by the old config but not the new one are stopped, newly enabled
+// ones started, those whose options changed reconfigured, and the nick resent if
+// it changed. Handlers added with AddHandler are left running. The room must
+// be running, and Reconfigure must not be called from a handler's goroutine
+// as it waits for the dispatcher. An error is returned if the room is stopped.
+func (r *Room) Reconfigure(cfg *RoomConfig) (*ReloadReport, error) {
+	handlers, err := configuredHandlers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	req := &reconfigRequest{cfg: cfg, handlers: handlers, report: make(chan *ReloadReport, 1)}
+	select {
+	case r.reconfChan <- req:
+	case <-r.stopChan:
+		return nil, errors.New("Room is stopped.")
+	}
+	report := <-req.report
+	r.Logger.Infof("Reconfigured room: %s", report)
+	return report, nil
+}
+
+// SetNick changes the bot's nick, keeping it when reconnecting.
+func (r *Room) SetNick(nick string) (*ReloadReport, error) {
+	cfg := *r.roomConfig()
+	cfg.Nick = nick
+	return r.Reconfigure(&cfg)
+}
+
+// DisableHandler stops the named handler until the room is next reconfigured
+// with it enabled. Like Reconfigure, it must not be called from a handler's
+// goroutine, nor must PauseHandler, ResumeHandler or FlushHandler.
+func (r *Room) DisableHandler(name string) error {
+	return r.controlHandler(name, ControlStop)
+}
+
+// PauseHandler stops the named handler processing packets until it is resumed.
+func (r *Room) PauseHandler(name string) error {
+	return r.controlHandler(name, ControlPause)
+}
+
+// ResumeHandler resumes a handler paused with PauseHandler.
+func (r *Room) ResumeHandler(name string) error {
+	return r.controlHandler(name, ControlResume)
+}
+
+// FlushHandler waits for the named handler to finish any work it has buffered.
+func (r *Room) FlushHandler(name string) error {
+	return r.controlHandler(name, ControlFlush)
+}
+
+func (r *Room) controlHandler(name string, ct ControlType) error {
+	req := &reconfigRequest{target: name, control: &Control{Type: ct},
+		report: make(chan *ReloadReport, 1)}
+	select {
+	case r.reconfChan <- req:
+	case <-r.stopChan:
+		return errors.New("Room is stopped.")
+	}
+	report := <-req.report
+	if len(report.Applied) == 0 {
+		return fmt.Errorf("Handler '%s' is not running.", name)
+	}
+	r.Logger.Infof("Sent %s to handler %s.", ct, name)
+	return nil
+}
+
+// applyControl is run by the dispatcher to send a control message to a single
+// handler, returning the handlers running afterwards.
+func (r *Room) applyControl(req *reconfigRequest, running []*runningHandler) []*runningHandler {
+	report := &ReloadReport{}
+	var kept []*runningHandler
+	var configured []string
+	r.handlers = nil
+	for _, rh := range running {
+		if rh.name == req.target {
+			r.sendControl(rh, req.control)
+			report.Applied = append(report.Applied, fmt.Sprintf("sent %s to handler %s", req.control.Type, rh.name))
+			if req.control.Type == ControlStop {
+				continue
+			}
+		}
+		kept = append(kept, rh)
+		r.handlers = append(r.handlers, rh.namedHandler)
+		if rh.configured {
+			configured = append(configured, rh.name)
+		}
+	}
+	if len(report.Applied) > 0 && req.control.Type == ControlStop {
+		// Name the remaining handlers explicitly so that they, and not the
+		// defaults, are what a later Reconfigure compares against.
+		cfg := *r.roomConfig()
+		cfg.Handlers = configured
+		r.configMu.Lock()
+		r.config = &cfg
+		r.configMu.Unlock()
+	}
+	req.report <- report
+	return kept
+}
+
+// applyConfig is run by the dispatcher to apply a reconfigure request,
+// returning the handlers running afterwards.
+func (r *Room) applyConfig(req *reconfigRequest, running []*runningHandler) []*runningHandler {
+	report := &ReloadReport{}
+	old := r.roomConfig()
+	cfg := *req.cfg
+	if cfg.DBPath != old.DBPath {
+		report.Skipped = append(report.Skipped, fmt.Sprintf("db path '%s'", cfg.DBPath))
+		cfg.DBPath = old.DBPath
+	}
+	if cfg.CookiePath != old.CookiePath {
+		report.Skipped = append(report.Skipped, fmt.Sprintf("cookie file '%s'", cfg.CookiePath))
+		cfg.CookiePath = old.CookiePath
+	}
+	if cfg.ErrorLogPath != old.ErrorLogPath {
+		report.Skipped = append(report.Skipped, fmt.Sprintf("log path '%s'", cfg.ErrorLogPath))
+		cfg.ErrorLogPath = old.ErrorLogPath
+	}
+	r.configMu.Lock()
+	r.config = &cfg
+	r.configMu.Unlock()
+
+	enabled := make(map[string]empty)
+	for _, nh := range req.handlers {
+		enabled[nh.name] = empty{}
+	}
+	var kept []*runningHandler
+	isRunning := make(map[string]empty)
+	for _, rh := range running {
+		_, ok := enabled[rh.name]
+		optsChanged := !bytes.Equal(old.HandlerOptions[rh.name], cfg.HandlerOptions[rh.name])
+		if !rh.configured || (ok && !optsChanged) {
+			kept = append(kept, rh)
+			isRunning[rh.name] = empty{}
+			continue
+		}
+		if ok {
+			r.sendControl(rh, &Control{Type: ControlReconfigure, Options: cfg.HandlerOptions[rh.name]})
+			report.Applied = append(report.Applied, fmt.Sprintf("reconfigured handler %s with new options", rh.name))
+			kept = append(kept, rh)
+			isRunning[rh.name] = empty{}
+		} else {
+			r.sendControl(rh, &Control{Type: ControlStop})
+			report.Applied = append(report.Applied, fmt.Sprintf("stopped handler %s", rh.name))
+		}
+	}
+	for _, nh := range req.handlers {
+		if _, ok := isRunning[nh.name]; ok {
+			continue
+		}
+		if rh := r.startHandler(nh); rh != nil {
+			report.Applied = append(report.Applied, fmt.Sprintf("started handler %s", nh.name))
+			kept = append(kept, rh)
+		} else {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("handler %s failed to start", nh.name))
+		}
+	}
+	r.handlers = nil
+	for _, rh := range kept {
+		r.handlers = append(r.handlers, rh.namedHandler)
+	}
+
+	if cfg.Nick != old.Nick {
+		r.SendNick(cfg.Nick)
+		report.Applied = append(report.Applied, fmt.Sprintf("changed nick from %s to %s", old.Nick, cfg.Nick))
+	}
+	if cfg.Password != old.Password {
+		report.Applied = append(report.Applied, "changed password, to be sent on next connect")
+	}
+	if cfg.MsgLogMaxAge != old.MsgLogMaxAge || cfg.MsgLogMaxCount != old.MsgLogMaxCount ||
+		cfg.PruneInterval != old.PruneInterval {
+		report.Applied = append(report.Applied, "changed message log retention")
+	}
+	req.report <- report
+	return kept
+}
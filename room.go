@@ -1,133 +1,414 @@
 package maimai
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/boltdb/bolt"
 )
 
 type empty struct{}
 
+// logPageSize is the number of messages requested per log command while
+// backfilling; it is the maximum the server will return.
+const logPageSize = 1000
+
+// maxBackfillPages is the most pages of history a backfill requests, so a bot
+// whose newest logged message is far back does not page through the room's
+// entire history.
+const maxBackfillPages = 10
+
 type roomData struct {
-	msgID       int
-	seen        map[string]time.Time
-	userLeaving map[string]empty
+	sync.Mutex
+	msgID         int
+	seen          map[string]time.Time
+	userLeaving   map[string]empty
+	backfilling   bool
+	backfillUntil string
+	backfillSince int64
+	backfillPages int
+
+	// hello is the current connection's hello-event, and ready is closed
+	// once it is set up. setUp is true from then until the next connection.
+	hello *HelloEvent
+	ready chan empty
+	setUp bool
+	// self is the bot's session, with the nick the server last confirmed.
+	self SessionView
+	// lastMessage is when the latest send-event was received, after which
+	// an idle private message room is closed.
+	lastMessage time.Time
+	// replies holds the channels sendCommand waits on, by packet ID, and
+	// editIDs the ID of the latest edit of each message the bot edited
+	// recently, those in edited, oldest first.
+	replies map[string]chan *PacketEvent
+	editIDs map[string]string
+	edited  []string
+}
+
+type namedHandler struct {
+	name string
+	// newHandler creates the handler each time it is started.
+	newHandler func() PacketHandler
+	// configured is true for handlers enabled by the room's config, which
+	// are started and stopped by Reconfigure.
+	configured bool
+	// recording is true for handlers created by a RecordingHandler, which
+	// are passed the messages the room ignores.
+	recording bool
 }
 
+func newNamedHandler(name string, h HandlerFactory, configured bool) namedHandler {
+	_, recording := h.(recordingHandler)
+	return namedHandler{name, h.NewHandler, configured, recording}
+}
+
+// defaultPruneInterval is how often the message log is pruned if
+// RoomConfig.PruneInterval is not set.
+const defaultPruneInterval = time.Hour
+
+// Defaults for RoomConfig.HandlerCrashLimit and HandlerRestartDelay. Restart
+// delays double after each crash, up to maxHandlerRestartDelay, and a handler
+// that runs for handlerCrashResetPeriod without crashing has its crash count
+// reset.
+const (
+	defaultHandlerCrashLimit   = 5
+	defaultHandlerRestartDelay = time.Second
+	maxHandlerRestartDelay     = time.Minute
+	handlerCrashResetPeriod    = time.Hour
+)
+
+// replyTimeout is how long sendCommand waits for the server's reply.
+const replyTimeout = 10 * time.Second
+
+// defaultSetupTimeout is used if RoomConfig.SetupTimeout is not set.
+const defaultSetupTimeout = 30 * time.Second
+
 // RoomConfig stores configuration options specific to a Room.
 type RoomConfig struct {
 	DBPath       string
 	ErrorLogPath string
 	Join         bool
 	MsgLog       bool
-	MsgPrefix    string
 	Nick         string
 	Password     string
+
+	// NickSuffix, if set, is appended to Nick if another session in the room
+	// is already using it when the bot enters.
+	NickSuffix string
+
+	// Email and AccountPassword, if set, log the bot in to its account.
+	// CookiePath is where the main binary keeps the bot's cookies.
+	Email           string
+	AccountPassword string
+	CookiePath      string
+
+	// Owners lists the IDs of the users allowed to use admin commands.
+	Owners []string
+
+	// Ignore lists the IDs of users, and glob patterns matching the nicks of
+	// users, whose messages handlers do not respond to. A sender replying to
+	// the bot more than LoopLimit times within LoopWindow is also ignored,
+	// until it slows down. Zero values use the defaults.
+	Ignore     []string
+	LoopLimit  int
+	LoopWindow time.Duration
+
+	// Handlers names the registered handlers the room runs, replacing the
+	// default set if not empty. The auth handler is run in rooms with a
+	// Password regardless. HandlerOptions holds each handler's options, which
+	// it reads with Room.HandlerOptions.
+	Handlers       []string
+	HandlerOptions map[string]json.RawMessage
+
+	// PMHandlers names the handlers run in private message rooms, replacing
+	// the default set if not empty. At most MaxPMs are open at once, each
+	// closed once nothing has been said in it for PMIdleTimeout. Zero values
+	// use the defaults.
+	PMHandlers    []string
+	MaxPMs        int
+	PMIdleTimeout time.Duration
+
+	// MsgLogMaxAge and MsgLogMaxCount limit how long and how many messages
+	// are kept in the message log. Zero values keep messages forever.
+	MsgLogMaxAge   time.Duration
+	MsgLogMaxCount int
+	PruneInterval  time.Duration
+
+	// A handler that panics is restarted after HandlerRestartDelay, doubling
+	// with each crash, until it has crashed more than HandlerCrashLimit
+	// times within an hour of each other, when it is disabled. Zero values
+	// use the defaults.
+	HandlerCrashLimit   int
+	HandlerRestartDelay time.Duration
+
+	// SetupTimeout is how long the bot waits after connecting for the room
+	// to let it in before reconnecting. Zero uses the default.
+	SetupTimeout time.Duration
 }
 
 // Room represents a connection to a euphoria room and associated data.
 type Room struct {
-	data     *roomData
-	config   *RoomConfig
-	db       *bolt.DB
-	handlers []Handler
-	uptime   time.Time
-	inbound  chan *PacketEvent
-	outbound chan *PacketEvent
-	errChan  chan error
-	sr       SenderReceiver
-	cmdChan  chan string
-	Logger   *logrus.Logger
-	wg       sync.WaitGroup
+	data       *roomData
+	config     *RoomConfig
+	configMu   sync.RWMutex
+	loader     ConfigLoader
+	reconfChan chan *reconfigRequest
+	store      Store
+	ownsStore  bool
+	validator  *packetValidator
+	filter     *messageFilter
+	pending    chan empty
+	handlers   []namedHandler
+	uptime     time.Time
+	inbound    chan *PacketEvent
+	outbound   chan *PacketEvent
+	errChan    chan error
+	sr         SenderReceiver
+	cmdChan    chan string
+	stopChan   chan empty
+	stopOnce   sync.Once
+	errMu      sync.Mutex
+	err        error
+	ctx        context.Context
+	cancel     context.CancelFunc
+	parent     *Room
+	pmMu       sync.Mutex
+	pms        map[string]*Room
+	Logger     *logrus.Logger
+	wg         sync.WaitGroup
+}
+
+func (r *Room) storeMsgLog(msgs []Message) {
+	if err := r.store.StoreMsgLog(msgs); err != nil {
+		r.Logger.Errorf("Error logging messages: %s", err)
+	}
 }
 
 func (r *Room) storeMsgLogEvent(msgID string, msg *MsgLogEvent) {
-	data, _ := json.Marshal(msg)
-	err := r.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("MsgLog"))
-		b.Put([]byte(msgID), data)
-		return nil
-	})
-	if err != nil {
+	if err := r.store.StoreMsgLogEvent(msgID, msg); err != nil {
 		r.Logger.Errorf("Error logging message: %s", err)
 	}
 }
 
-// NewRoom creates a new room with the given configurations.
+func (r *Room) storeMsgLogEdit(edit *EditMessageEvent) {
+	if err := r.store.StoreMsgLogEdit(edit); err != nil {
+		r.Logger.Errorf("Error logging message edit: %s", err)
+	}
+}
+
+// NewRoom creates a new room with the given configurations, storing its data
+// in a BoltDB database at roomCfg.DBPath, which is closed when it is stopped.
 func NewRoom(roomCfg *RoomConfig, room string, sr SenderReceiver, logger *logrus.Logger) (*Room, error) {
-	db, err := bolt.Open(roomCfg.DBPath, 0666, nil)
+	store, err := NewBoltStore(roomCfg.DBPath)
 	if err != nil {
 		return nil, err
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("Seen"))
-		if err != nil {
-			return fmt.Errorf("Error creating bucket 'Seen': %s", err)
-		}
-		return nil
-	})
+	r, err := NewRoomWithStore(roomCfg, room, sr, store, logger)
 	if err != nil {
+		store.Close()
 		return nil, err
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("MsgLog"))
-		if err != nil {
-			return fmt.Errorf("Error creating bucket 'MsgLog': %s", err)
-		}
-		return nil
-	})
+	r.ownsStore = true
+	return r, nil
+}
+
+// NewRoomWithStore creates a new room with the given configurations, storing
+// its data in store. The store is migrated to the current SchemaVersion.
+func NewRoomWithStore(roomCfg *RoomConfig, room string, sr SenderReceiver, store Store, logger *logrus.Logger) (*Room, error) {
+	report, err := Migrate(store, false)
 	if err != nil {
 		return nil, err
 	}
-	var handlers []Handler
-	// TODO : change this to read handler config from file
-	handlers = append(handlers, PingEventHandler)
-	handlers = append(handlers, PingCommandHandler)
-	handlers = append(handlers, SeenCommandHandler)
-	handlers = append(handlers, SeenRecordHandler)
-	handlers = append(handlers, LinkTitleHandler)
-	handlers = append(handlers, UptimeCommandHandler)
-	handlers = append(handlers, ScritchCommandHandler)
-	handlers = append(handlers, DebugHandler)
-	if roomCfg.Join {
-		handlers = append(handlers, NickChangeHandler)
-		handlers = append(handlers, JoinEventHandler)
-		handlers = append(handlers, PartEventHandler)
-	}
-	if roomCfg.MsgLog {
-		handlers = append(handlers, MessageLogHandler)
+	if report.From != report.To {
+		logger.Infoln(report)
 	}
-	// handlers = append(handlers, SuttaCommandHandler)
 	inbound := make(chan *PacketEvent, 4)
 	outbound := make(chan *PacketEvent, 4)
 	errChan := make(chan error)
 	cmdChan := make(chan string)
-	return &Room{&roomData{0, make(map[string]time.Time),
-		make(map[string]empty)}, roomCfg, db, handlers, time.Now(),
-		inbound, outbound, errChan, sr, cmdChan, logger, sync.WaitGroup{}}, nil
+	data := &roomData{
+		seen:        make(map[string]time.Time),
+		userLeaving: make(map[string]empty),
+		replies:     make(map[string]chan *PacketEvent),
+		editIDs:     make(map[string]string),
+	}
+	r := &Room{
+		data:       data,
+		config:     roomCfg,
+		reconfChan: make(chan *reconfigRequest),
+		store:      store,
+		validator:  newPacketValidator(),
+		filter:     newMessageFilter(),
+		pending:    make(chan empty, maxPendingReplies),
+		uptime:     time.Now(),
+		inbound:    inbound,
+		outbound:   outbound,
+		errChan:    errChan,
+		sr:         sr,
+		cmdChan:    cmdChan,
+		stopChan:   make(chan empty),
+		pms:        make(map[string]*Room),
+		Logger:     logger,
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	handlers, err := configuredHandlers(roomCfg)
+	if err != nil {
+		return nil, err
+	}
+	r.handlers = handlers
+	return r, nil
+}
+
+// configuredHandlers looks up the handlers enabled by roomCfg in the registry.
+// The auth handler is always enabled for rooms with a password.
+func configuredHandlers(roomCfg *RoomConfig) ([]namedHandler, error) {
+	names := roomCfg.Handlers
+	if len(names) == 0 {
+		names = defaultHandlers(roomCfg)
+	}
+	var handlers []namedHandler
+	added := make(map[string]empty)
+	for _, name := range names {
+		h, ok := handlerRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown handler '%s'.", name)
+		}
+		if _, ok := added[name]; ok {
+			return nil, fmt.Errorf("Handler '%s' given twice.", name)
+		}
+		added[name] = empty{}
+		handlers = append(handlers, newNamedHandler(name, h, true))
+	}
+	if _, ok := added["auth"]; !ok && roomCfg.Password != "" {
+		handlers = append(handlers, newNamedHandler("auth", handlerRegistry["auth"], true))
+	}
+	return handlers, nil
+}
+
+// defaultHandlers returns the names of the handlers a room runs if none are
+// given in its config.
+func defaultHandlers(roomCfg *RoomConfig) []string {
+	names := []string{"ping-event", "bot-commands", "seen-command",
+		"seen-record", "log-backfill", "link-title", "uptime-command",
+		"scritch-command", "debug", "admin", "auth", "pm"}
+	if roomCfg.Join {
+		names = append(names, "nick-change", "join-event", "part-event")
+	}
+	if roomCfg.MsgLog {
+		names = append(names, "message-log", "history-command")
+	}
+	if roomCfg.Email != "" {
+		names = append(names, "login")
+	}
+	return names
+}
+
+// HandlerOptions decodes the options configured for the named handler into v,
+// returning false if there are none.
+func (r *Room) HandlerOptions(name string, v interface{}) (bool, error) {
+	data, ok := r.roomConfig().HandlerOptions[name]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// AddHandler registers a handler under the given name. Handlers must be added
+// before the room is run, and names must be unique within a room as they
+// identify the handler's storage; see KV. An error is returned if the name is
+// already in use.
+func (r *Room) AddHandler(name string, h HandlerFactory) error {
+	for _, nh := range r.handlers {
+		if nh.name == name {
+			return fmt.Errorf("Handler '%s' already added.", name)
+		}
+	}
+	r.handlers = append(r.handlers, newNamedHandler(name, h, false))
+	return nil
 }
 
 func (r *Room) sendPayload(payload interface{}, pType PacketType) {
-	msg, err := MakePacket(strconv.Itoa(r.data.msgID), pType, payload)
+	r.sendPacket(r.nextPacketID(), payload, pType)
+}
+
+// nextPacketID returns the ID for the next packet sent, which the server
+// gives its reply.
+func (r *Room) nextPacketID() string {
+	r.data.Lock()
+	defer r.data.Unlock()
+	id := strconv.Itoa(r.data.msgID)
+	r.data.msgID++
+	return id
+}
+
+func (r *Room) sendPacket(id string, payload interface{}, pType PacketType) {
+	msg, err := MakePacket(id, pType, payload)
 	if err != nil {
 		r.Logger.Errorf("Error sending payload type %s: %v", pType, payload)
+		return
 	}
 	go func() {
 		r.outbound <- msg
 	}()
-	r.data.msgID++
+}
+
+// sendCommand sends a command and waits for the server's reply, returning an
+// error if the reply is an error or does not arrive within replyTimeout. It
+// must not be called from a handler's loop, which would stop the dispatcher
+// passing on the reply; handlers call it from a goroutine of their own.
+func (r *Room) sendCommand(payload interface{}, pType PacketType) (*PacketEvent, error) {
+	id := r.nextPacketID()
+	reply := make(chan *PacketEvent, 1)
+	r.data.Lock()
+	r.data.replies[id] = reply
+	r.data.Unlock()
+	defer func() {
+		r.data.Lock()
+		delete(r.data.replies, id)
+		r.data.Unlock()
+	}()
+	r.sendPacket(id, payload, pType)
+	select {
+	case packet := <-reply:
+		if packet.Error != "" {
+			return packet, fmt.Errorf("%s failed: %s", pType, packet.Error)
+		}
+		return packet, nil
+	case <-time.After(replyTimeout):
+		return nil, fmt.Errorf("No reply to %s.", pType)
+	case <-r.stopChan:
+		return nil, errors.New("Room is stopped.")
+	}
+}
+
+// deliverReply passes an inbound packet to the sendCommand waiting for it, if
+// any.
+func (r *Room) deliverReply(packet *PacketEvent) {
+	if packet.ID == "" {
+		return
+	}
+	r.data.Lock()
+	reply, ok := r.data.replies[packet.ID]
+	r.data.Unlock()
+	if ok {
+		select {
+		case reply <- packet:
+		default:
+		}
+	}
 }
 
 // Auth sends an authentication packet with the given password.
 func (r *Room) SendAuth() {
 	payload := AuthCommand{
 		Type:     "passcode",
-		Passcode: r.config.Password}
+		Passcode: r.roomConfig().Password}
 	r.sendPayload(payload, AuthType)
 }
 
@@ -151,67 +432,259 @@ func (r *Room) SendNick(nick string) {
 	r.sendPayload(payload, NickType)
 }
 
-func (r *Room) storeSeen(user string, time int64) error {
-	err := r.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("Seen"))
-		b.Put([]byte(user), []byte(strconv.FormatInt(time, 10)))
-		return nil
-	})
-	return err
+// SendLogin sends a login command for the account with the given email.
+func (r *Room) SendLogin(email string, password string) {
+	payload := LoginCommand{
+		Namespace: "email",
+		ID:        email,
+		Password:  password}
+	r.sendPayload(payload, LoginType)
 }
 
-func (r *Room) retrieveSeen(user string) ([]byte, error) {
-	var t []byte
-	err := r.db.View(func(tx *bolt.Tx) error {
-		t = tx.Bucket([]byte("Seen")).Get([]byte(user))
-		return nil
-	})
-	return t, err
+// SendLog sends a log command requesting up to n messages sent before the
+// message with the given ID. An empty before requests the most recent messages.
+func (r *Room) SendLog(n int, before string) {
+	payload := LogCommand{
+		N:      n,
+		Before: before}
+	r.sendPayload(payload, LogType)
+}
+
+// startBackfill records the newest message in the log and requests the most
+// recent page of the room's history. LogBackfillHandler keeps paging back
+// until it reaches the recorded message, so nothing said while the bot was
+// disconnected is missing from MsgLog and Seen. Nothing is backfilled if the
+// message log is disabled or empty, and at most maxBackfillPages pages, and
+// no messages older than MsgLogMaxAge or beyond MsgLogMaxCount, are requested.
+func (r *Room) startBackfill() {
+	cfg := r.roomConfig()
+	if !cfg.MsgLog {
+		return
+	}
+	latest, err := r.store.LatestMsgLogID()
+	if err != nil {
+		r.Logger.Errorf("Error reading message log, not backfilling: %s", err)
+		return
+	}
+	if latest == "" {
+		r.Logger.Debugln("Message log is empty, not backfilling.")
+		return
+	}
+	var since int64
+	if cfg.MsgLogMaxAge != 0 {
+		since = time.Now().Add(-cfg.MsgLogMaxAge).Unix()
+	}
+	r.data.Lock()
+	r.data.backfilling = true
+	r.data.backfillUntil = latest
+	r.data.backfillSince = since
+	r.data.backfillPages = maxBackfillPages
+	if cfg.MsgLogMaxCount > 0 {
+		pages := (cfg.MsgLogMaxCount + logPageSize - 1) / logPageSize
+		if pages < r.data.backfillPages {
+			r.data.backfillPages = pages
+		}
+	}
+	r.data.Unlock()
+	r.Logger.Debugf("Backfilling message log until ID '%s'.", latest)
+	r.SendLog(logPageSize, "")
+}
+
+// nextBackfillPage returns the ID to page back from after receiving the
+// given log reply, and false if the backfill is complete.
+func (r *Room) nextBackfillPage(reply *LogReply) (string, bool) {
+	r.data.Lock()
+	defer r.data.Unlock()
+	if !r.data.backfilling {
+		return "", false
+	}
+	r.data.backfillPages--
+	if len(reply.Log) < logPageSize || reply.Log[0].ID <= r.data.backfillUntil ||
+		reply.Log[0].Time < r.data.backfillSince || r.data.backfillPages <= 0 {
+		r.data.backfilling = false
+		return "", false
+	}
+	return reply.Log[0].ID, true
+}
+
+// runningHandler is a handler started by the dispatcher and the channels it
+// is sent packets and control messages on.
+type runningHandler struct {
+	namedHandler
+	handler PacketHandler
+	input   chan PacketEvent
+	control chan *Control
 }
 
 func (r *Room) dispatcher() {
-	var fanout [](chan PacketEvent)
-	var cmdChans [](chan string)
-	for i, h := range r.handlers {
-		fanout = append(fanout, make(chan PacketEvent, 4))
-		cmdChans = append(cmdChans, make(chan string, 1))
-		r.wg.Add(1)
-		go func(hd Handler, msgCh chan PacketEvent, cmdCh chan string) {
-			defer r.wg.Done()
-			hd(r, msgCh, cmdCh)
-		}(h, fanout[i], cmdChans[i])
+	var running []*runningHandler
+	for _, nh := range r.handlers {
+		if rh := r.startHandler(nh); rh != nil {
+			running = append(running, rh)
+		}
 	}
 	for {
 		select {
 		case inboundMsg := <-r.inbound:
-			for _, channel := range fanout {
-				channel <- *inboundMsg
+			if !r.validatePacket(inboundMsg) {
+				continue
+			}
+			r.deliverReply(inboundMsg)
+			if inboundMsg.Type == SendEventType {
+				r.data.Lock()
+				r.data.lastMessage = time.Now()
+				r.data.Unlock()
+			}
+			r.filterMessage(inboundMsg)
+			for _, rh := range running {
+				if inboundMsg.ignored && !rh.recording {
+					continue
+				}
+				rh.input <- *inboundMsg
+			}
+			if ready := r.trackSession(inboundMsg); ready != nil {
+				for _, rh := range running {
+					rh.input <- *ready
+				}
 			}
 		case cmd := <-r.cmdChan:
-			for _, channel := range cmdChans {
-				channel <- cmd
+			for _, rh := range running {
+				r.sendControl(rh, &Control{Type: ControlStop})
 			}
 			r.Logger.Warningf("command received and dispatched, exiting: %s", cmd)
 			return
+		case req := <-r.reconfChan:
+			if req.control != nil {
+				running = r.applyControl(req, running)
+			} else {
+				running = r.applyConfig(req, running)
+			}
 		case err := <-r.errChan:
+			if _, ok := err.(*AuthError); ok {
+				r.Logger.Errorf("Stopping room: %s", err)
+				r.setErr(err)
+				go r.Stop()
+				continue
+			}
 			r.Logger.Fatalf("Unhandled error received from handler: %s\n", err)
 		}
 	}
 }
 
+// reportError sends err to the dispatcher without waiting for it, for
+// handlers that cannot block. Errors after the room has stopped are dropped.
+func (r *Room) reportError(err error) {
+	go func() {
+		select {
+		case r.errChan <- err:
+		case <-r.stopChan:
+		}
+	}()
+}
+
+func (r *Room) setErr(err error) {
+	r.errMu.Lock()
+	r.err = err
+	r.errMu.Unlock()
+}
+
+// Err returns the error the room was stopped by, such as an *AuthError, or
+// nil if it is running or was stopped with Stop.
+func (r *Room) Err() error {
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	return r.err
+}
+
 // Run provides a method for setup and the main loop that the bot will run with handlers.
 func (r *Room) Run() {
 	if err := r.sr.connect(r); err != nil {
 		r.Logger.Error("Could not connect to euphoria.")
 	}
 	go r.sr.start(r, r.inbound, r.outbound)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.pruner()
+	}()
 	r.dispatcher()
 }
 
+// Stop stops the room's handlers and disconnects. Only the first call has any
+// effect, and later calls wait for it to finish.
 func (r *Room) Stop() {
-	r.cmdChan <- "kill"
-	r.sr.stop()
-	r.wg.Wait()
+	r.stopOnce.Do(func() {
+		r.cancel()
+		r.cmdChan <- "kill"
+		close(r.stopChan)
+		r.sr.stop()
+		r.wg.Wait()
+		r.stopPMs()
+		if r.ownsStore {
+			if err := r.store.Close(); err != nil {
+				r.Logger.Errorf("Error closing store: %s", err)
+			}
+		}
+	})
+}
+
+// Stopped returns true once the room is being stopped, by Stop or by an error
+// such as an *AuthError. A stopped room cannot be run again.
+func (r *Room) Stopped() bool {
+	return r.ctx.Err() != nil
+}
+
+// pruner prunes the message log according to the room's retention limits
+// every PruneInterval until the room is stopped.
+func (r *Room) pruner() {
+	for {
+		r.pruneMsgLog()
+		interval := r.roomConfig().PruneInterval
+		if interval == 0 {
+			interval = defaultPruneInterval
+		}
+		select {
+		case <-time.After(interval):
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+func (r *Room) pruneMsgLog() {
+	cfg := r.roomConfig()
+	if cfg.MsgLogMaxAge == 0 && cfg.MsgLogMaxCount == 0 {
+		return
+	}
+	var before int64
+	if cfg.MsgLogMaxAge != 0 {
+		before = time.Now().Add(-cfg.MsgLogMaxAge).Unix()
+	}
+	pruned, err := r.store.PruneMsgLog(before, cfg.MsgLogMaxCount)
+	if err != nil {
+		r.Logger.Errorf("Error pruning message log: %s", err)
+		return
+	}
+	if pruned > 0 {
+		r.Logger.Infof("Pruned %d messages from the message log.", pruned)
+	}
+}
+
+// ForgetUser removes the messages and seen records of the user with the given
+// ID, returning how many of each were removed. Seen records are kept by nick,
+// so those removed are the ones for each nick the user's logged messages were
+// sent under. A nick another user's logged messages were also sent under is
+// shared, and its seen record is kept; one used only by users whose messages
+// were not logged is removed all the same. Messages still in the room's
+// history will be logged again if they are backfilled.
+func (r *Room) ForgetUser(userID string) (int, int, error) {
+	msgCount, seenCount, err := r.store.ForgetUser(userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	r.Logger.Infof("Forgot user %s: removed %d messages and %d seen records.",
+		userID, msgCount, seenCount)
+	return msgCount, seenCount, nil
 }
 
 func (r *Room) isUserLeaving(user string) bool {
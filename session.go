@@ -0,0 +1,189 @@
+package maimai
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// beginSetup is called on connecting. The server sends a hello-event, bounces
+// the bot if the room is private (see AuthHandler), and sends a snapshot-event
+// once the bot has entered the room. If that does not happen within the
+// room's SetupTimeout, the connection is dropped and made again.
+func (r *Room) beginSetup() {
+	ready := make(chan empty)
+	r.data.Lock()
+	r.data.hello = nil
+	r.data.ready = ready
+	r.data.setUp = false
+	r.data.Unlock()
+	timeout := r.roomConfig().SetupTimeout
+	if timeout == 0 {
+		timeout = defaultSetupTimeout
+	}
+	go func() {
+		select {
+		case <-ready:
+		case <-time.After(timeout):
+			r.data.Lock()
+			current := r.data.ready == ready
+			r.data.Unlock()
+			if current {
+				r.Logger.Warningf("Connection not set up after %s, reconnecting.", timeout)
+				r.sr.reconnect()
+			}
+		case <-r.stopChan:
+		}
+	}()
+}
+
+// trackSession follows the bot's session through the inbound packets the
+// dispatcher receives. On the first snapshot-event of a connection it sends
+// the bot's nick, starts backfilling the message log and returns a
+// ready-event for the dispatcher to pass to handlers. It returns nil
+// otherwise.
+func (r *Room) trackSession(packet *PacketEvent) *PacketEvent {
+	switch packet.Type {
+	case HelloEventType:
+		hello, err := GetHelloEventPayload(packet)
+		if err != nil {
+			return nil
+		}
+		r.data.Lock()
+		r.data.hello = hello
+		r.data.self = hello.Session
+		r.data.Unlock()
+	case SnapshotEventType:
+		snapshot, err := GetSnapshotEventPayload(packet)
+		if err != nil {
+			return nil
+		}
+		return r.enterRoom(snapshot)
+	case NickReplyType:
+		if packet.Error != "" {
+			r.Logger.Errorf("Could not set nick: %s", packet.Error)
+			return nil
+		}
+		reply, err := GetNickReplyPayload(packet)
+		if err != nil {
+			return nil
+		}
+		r.data.Lock()
+		r.data.self.ID = reply.ID
+		r.data.self.SessionID = reply.SessionID
+		r.data.self.Name = reply.To
+		r.data.Unlock()
+	case JoinEventType:
+		data, err := GetPresenceEventPayload(packet)
+		if err != nil || data.User == nil {
+			return nil
+		}
+		r.checkImpersonation(data.SessionID, data.Name)
+	case NickEventType:
+		data, err := GetNickEventPayload(packet)
+		if err != nil {
+			return nil
+		}
+		r.checkImpersonation(data.SessionID, data.To)
+	}
+	return nil
+}
+
+// enterRoom sets up the connection on its first snapshot-event, adding the
+// room's NickSuffix to the bot's nick if another session is using it.
+func (r *Room) enterRoom(snapshot *SnapshotEvent) *PacketEvent {
+	r.data.Lock()
+	if r.data.setUp {
+		r.data.Unlock()
+		return nil
+	}
+	r.data.setUp = true
+	if r.data.ready != nil {
+		close(r.data.ready)
+		r.data.ready = nil
+	}
+	event := ReadyEvent{}
+	if hello := r.data.hello; hello != nil {
+		event.Session = hello.Session
+		event.Account = hello.Account
+	}
+	r.data.Unlock()
+	cfg := r.roomConfig()
+	nick := cfg.Nick
+	for _, session := range snapshot.Listing {
+		if session.SessionID != snapshot.SessionID && sameNick(session.Name, nick) {
+			r.Logger.Warningf("Nick %s is in use by session %s (%s).", nick, session.SessionID, session.ID)
+			nick += cfg.NickSuffix
+			break
+		}
+	}
+	r.Logger.Debugln("Entered room, sending nick.")
+	r.SendNick(nick)
+	// Private message rooms share the store of the room they were opened
+	// from, whose message log they must not add to.
+	if r.parent == nil {
+		r.startBackfill()
+	}
+	ready, err := MakePacket("", ReadyEventType, event)
+	if err != nil {
+		r.Logger.Errorf("Error making ready event: %s", err)
+		return nil
+	}
+	ready.payload = &event
+	return ready
+}
+
+// checkImpersonation warns if a session other than the bot's takes its nick.
+func (r *Room) checkImpersonation(sessionID string, nick string) {
+	self := r.Self()
+	if sessionID != self.SessionID && self.Name != "" && sameNick(nick, self.Name) {
+		r.Logger.Warningf("Session %s is using the bot's nick %s.", sessionID, nick)
+	}
+}
+
+// normalizeNick returns a nick as it is compared, ignoring case and spaces.
+func normalizeNick(nick string) string {
+	return strings.ToLower(strings.Join(strings.Fields(nick), ""))
+}
+
+// sameNick returns true if two nicks are the same to users.
+func sameNick(a string, b string) bool {
+	return normalizeNick(a) == normalizeNick(b)
+}
+
+// isSelfNick returns true if nick is the bot's, as confirmed by the server, or
+// as configured before the server has confirmed one.
+func (r *Room) isSelfNick(nick string) bool {
+	if name := r.Self().Name; name != "" {
+		return sameNick(nick, name)
+	}
+	return sameNick(nick, r.roomConfig().Nick)
+}
+
+// isSelf returns true if the session with the given ID and user is the bot's,
+// or another session of the same agent or account.
+func (r *Room) isSelf(sessionID string, user User) bool {
+	self := r.Self()
+	return (self.SessionID != "" && sessionID == self.SessionID) ||
+		(self.ID != "" && user.ID == self.ID)
+}
+
+// senderSessionID returns the session ID of the sender of a message packet,
+// which Message does not keep.
+func senderSessionID(packet *PacketEvent) string {
+	var data struct {
+		Sender struct {
+			SessionID string `json:"session_id"`
+		} `json:"sender"`
+	}
+	json.Unmarshal(packet.Data, &data)
+	return data.Sender.SessionID
+}
+
+// Self returns the bot's session in the room. Its name is the nick the server
+// last confirmed, and is empty before the bot has set one.
+func (r *Room) Self() SessionView {
+	r.data.Lock()
+	defer r.data.Unlock()
+	return r.data.self
+}
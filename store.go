@@ -0,0 +1,579 @@
+package maimai
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// Names of the buckets holding the data recorded by a Room.
+const (
+	seenBucket   = "Seen"
+	msgLogBucket = "MsgLog"
+)
+
+// ErrTxNotWritable is returned when writing to a bucket in a read-only transaction.
+var ErrTxNotWritable = errors.New("Transaction is not writable.")
+
+// Bucket is a collection of keys and values within a Store transaction. Keys
+// and values must not be modified or used after the transaction ends.
+type Bucket interface {
+	Get(key []byte) []byte
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	// Last returns the last key in the bucket and its value, or nil if empty.
+	Last() ([]byte, []byte)
+	// ForEach calls fn with each key and value in the bucket, in key order.
+	// The bucket must not be modified by fn.
+	ForEach(fn func(k, v []byte) error) error
+}
+
+// Tx is a transaction on a Store.
+type Tx interface {
+	// Bucket returns the named bucket. In a writable transaction it is
+	// created if it does not exist; in a read-only one a missing bucket is empty.
+	Bucket(name string) (Bucket, error)
+	// HasBucket reports whether the named bucket exists.
+	HasBucket(name string) bool
+}
+
+// Store persists the data a Room records: when users were last seen, the
+// message log and arbitrary key-value data for handlers.
+type Store interface {
+	// StoreSeen records that user was seen at the given unix time.
+	StoreSeen(user string, t int64) error
+	// StoreSeenTimes records each user as seen at the given unix time, unless
+	// a later time has already been recorded.
+	StoreSeenTimes(times map[string]int64) error
+	// RetrieveSeen returns when user was last seen, and false if never.
+	RetrieveSeen(user string) (int64, bool, error)
+
+	// StoreMsgLog logs the given messages, keeping any recorded edit history.
+	StoreMsgLog(msgs []Message) error
+	// StoreMsgLogEvent logs a message, keeping any recorded edit history.
+	StoreMsgLogEvent(msgID string, msg *MsgLogEvent) error
+	// StoreMsgLogEdit records an edit or deletion of a logged message.
+	StoreMsgLogEdit(edit *EditMessageEvent) error
+	// RetrieveMsgLogEvent returns the logged message with the given ID, or nil.
+	RetrieveMsgLogEvent(msgID string) (*MsgLogEvent, error)
+	// LatestMsgLogID returns the ID of the newest logged message, or "".
+	LatestMsgLogID() (string, error)
+	// PruneMsgLog removes logged messages sent before the given unix time, then
+	// the oldest messages until at most maxCount remain. A zero before or
+	// maxCount disables that limit. It returns the number of messages removed.
+	PruneMsgLog(before int64, maxCount int) (int, error)
+	// ForgetUser removes every logged message sent by the user with the given
+	// ID and the seen records of every nick they sent them with, except nicks
+	// other users' logged messages were also sent with. It returns the number
+	// of messages and seen records removed.
+	ForgetUser(userID string) (int, int, error)
+
+	// View runs fn in a read-only transaction.
+	View(fn func(tx Tx) error) error
+	// Update runs fn in a writable transaction, which is committed if fn
+	// returns nil and rolled back otherwise.
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+// kvBackend is a transactional key-value store that bucketStore builds the
+// rest of Store on top of.
+type kvBackend interface {
+	View(fn func(tx Tx) error) error
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+// bucketStore implements Store over a kvBackend. Seen times are stored as
+// decimal unix seconds keyed by user in the Seen bucket, and messages as JSON
+// encoded MsgLogEvents keyed by message ID in the MsgLog bucket.
+type bucketStore struct {
+	kvBackend
+}
+
+func (s bucketStore) StoreSeen(user string, t int64) error {
+	return s.Update(func(tx Tx) error {
+		b, err := tx.Bucket(seenBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(user), []byte(strconv.FormatInt(t, 10)))
+	})
+}
+
+func (s bucketStore) StoreSeenTimes(times map[string]int64) error {
+	return s.Update(func(tx Tx) error {
+		b, err := tx.Bucket(seenBucket)
+		if err != nil {
+			return err
+		}
+		for user, t := range times {
+			if prev := b.Get([]byte(user)); prev != nil {
+				prevTime, err := strconv.ParseInt(string(prev), 10, 64)
+				if err == nil && prevTime >= t {
+					continue
+				}
+			}
+			if err := b.Put([]byte(user), []byte(strconv.FormatInt(t, 10))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s bucketStore) RetrieveSeen(user string) (int64, bool, error) {
+	var t int64
+	var ok bool
+	err := s.View(func(tx Tx) error {
+		b, err := tx.Bucket(seenBucket)
+		if err != nil {
+			return err
+		}
+		data := b.Get([]byte(user))
+		if data == nil {
+			return nil
+		}
+		ok = true
+		t, err = strconv.ParseInt(string(data), 10, 64)
+		return err
+	})
+	return t, ok, err
+}
+
+func putMsgLogEvent(b Bucket, msgID string, msg *MsgLogEvent) error {
+	if prev := b.Get([]byte(msgID)); prev != nil {
+		var prevMsg MsgLogEvent
+		if err := json.Unmarshal(prev, &prevMsg); err == nil {
+			mergeMsgLogEvent(&prevMsg, msg)
+		}
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(msgID), data)
+}
+
+func (s bucketStore) StoreMsgLog(msgs []Message) error {
+	return s.Update(func(tx Tx) error {
+		b, err := tx.Bucket(msgLogBucket)
+		if err != nil {
+			return err
+		}
+		for i := range msgs {
+			msgID, msgLogEvent := prepareMsgLogEvent(&msgs[i])
+			if err := putMsgLogEvent(b, msgID, msgLogEvent); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s bucketStore) StoreMsgLogEvent(msgID string, msg *MsgLogEvent) error {
+	return s.Update(func(tx Tx) error {
+		b, err := tx.Bucket(msgLogBucket)
+		if err != nil {
+			return err
+		}
+		return putMsgLogEvent(b, msgID, msg)
+	})
+}
+
+func (s bucketStore) StoreMsgLogEdit(edit *EditMessageEvent) error {
+	return s.Update(func(tx Tx) error {
+		b, err := tx.Bucket(msgLogBucket)
+		if err != nil {
+			return err
+		}
+		var prev *MsgLogEvent
+		if data := b.Get([]byte(edit.ID)); data != nil {
+			prev = &MsgLogEvent{}
+			if err := json.Unmarshal(data, prev); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(applyMsgLogEdit(prev, edit))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(edit.ID), data)
+	})
+}
+
+func (s bucketStore) RetrieveMsgLogEvent(msgID string) (*MsgLogEvent, error) {
+	var msg *MsgLogEvent
+	err := s.View(func(tx Tx) error {
+		b, err := tx.Bucket(msgLogBucket)
+		if err != nil {
+			return err
+		}
+		data := b.Get([]byte(msgID))
+		if data == nil {
+			return nil
+		}
+		msg = &MsgLogEvent{}
+		return json.Unmarshal(data, msg)
+	})
+	return msg, err
+}
+
+func (s bucketStore) LatestMsgLogID() (string, error) {
+	var latest string
+	err := s.View(func(tx Tx) error {
+		b, err := tx.Bucket(msgLogBucket)
+		if err != nil {
+			return err
+		}
+		k, _ := b.Last()
+		latest = string(k)
+		return nil
+	})
+	return latest, err
+}
+
+func (s bucketStore) PruneMsgLog(before int64, maxCount int) (int, error) {
+	var pruned int
+	err := s.Update(func(tx Tx) error {
+		b, err := tx.Bucket(msgLogBucket)
+		if err != nil {
+			return err
+		}
+		// Message IDs sort in the order messages were sent, so the oldest
+		// messages to keep are at the end of the list.
+		var keep, remove [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			var msg MsgLogEvent
+			if before != 0 && json.Unmarshal(v, &msg) == nil && msg.Time < before {
+				remove = append(remove, k)
+			} else {
+				keep = append(keep, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if maxCount > 0 && len(keep) > maxCount {
+			remove = append(remove, keep[:len(keep)-maxCount]...)
+		}
+		for _, k := range remove {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(remove)
+		return nil
+	})
+	return pruned, err
+}
+
+func (s bucketStore) ForgetUser(userID string) (int, int, error) {
+	var msgCount, seenCount int
+	err := s.Update(func(tx Tx) error {
+		b, err := tx.Bucket(msgLogBucket)
+		if err != nil {
+			return err
+		}
+		var remove [][]byte
+		nicks := make(map[string]empty)
+		shared := make(map[string]empty)
+		err = b.ForEach(func(k, v []byte) error {
+			var msg MsgLogEvent
+			if json.Unmarshal(v, &msg) != nil {
+				return nil
+			}
+			nick := strings.Replace(msg.UserName, " ", "", -1)
+			if msg.UserID != userID {
+				shared[nick] = empty{}
+				return nil
+			}
+			remove = append(remove, k)
+			nicks[nick] = empty{}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range remove {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		msgCount = len(remove)
+		seen, err := tx.Bucket(seenBucket)
+		if err != nil {
+			return err
+		}
+		for nick := range nicks {
+			if _, ok := shared[nick]; ok {
+				continue
+			}
+			if seen.Get([]byte(nick)) == nil {
+				continue
+			}
+			if err := seen.Delete([]byte(nick)); err != nil {
+				return err
+			}
+			seenCount++
+		}
+		return nil
+	})
+	return msgCount, seenCount, err
+}
+
+// NewBoltStore opens or creates a BoltDB database at path and returns a Store
+// backed by it.
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bucketStore{&boltBackend{db}}, nil
+}
+
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func (bb *boltBackend) View(fn func(tx Tx) error) error {
+	return bb.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (bb *boltBackend) Update(fn func(tx Tx) error) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (bb *boltBackend) Close() error {
+	return bb.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Bucket(name string) (Bucket, error) {
+	if !t.tx.Writable() {
+		return boltBucket{t.tx.Bucket([]byte(name))}, nil
+	}
+	b, err := t.tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) HasBucket(name string) bool {
+	return t.tx.Bucket([]byte(name)) != nil
+}
+
+// boltBucket wraps a bolt bucket, which is nil for a bucket that does not
+// exist in a read-only transaction.
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+func (bb boltBucket) Get(key []byte) []byte {
+	if bb.b == nil {
+		return nil
+	}
+	return bb.b.Get(key)
+}
+
+func (bb boltBucket) Put(key []byte, value []byte) error {
+	if bb.b == nil {
+		return ErrTxNotWritable
+	}
+	return bb.b.Put(key, value)
+}
+
+func (bb boltBucket) Delete(key []byte) error {
+	if bb.b == nil {
+		return ErrTxNotWritable
+	}
+	return bb.b.Delete(key)
+}
+
+func (bb boltBucket) Last() ([]byte, []byte) {
+	if bb.b == nil {
+		return nil, nil
+	}
+	return bb.b.Cursor().Last()
+}
+
+func (bb boltBucket) ForEach(fn func(k, v []byte) error) error {
+	if bb.b == nil {
+		return nil
+	}
+	return bb.b.ForEach(fn)
+}
+
+// NewMemStore returns a Store that keeps its data in memory, for tests and
+// bots that do not need to persist anything.
+func NewMemStore() Store {
+	return bucketStore{&memBackend{buckets: make(map[string]map[string][]byte)}}
+}
+
+type memBackend struct {
+	sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func (mb *memBackend) View(fn func(tx Tx) error) error {
+	mb.RLock()
+	defer mb.RUnlock()
+	return fn(&memTx{mb, false, nil})
+}
+
+func (mb *memBackend) Update(fn func(tx Tx) error) error {
+	mb.Lock()
+	defer mb.Unlock()
+	tx := &memTx{mb, true, make(map[string]*memChanges)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for name, c := range tx.written {
+		b, ok := mb.buckets[name]
+		if !ok {
+			b = make(map[string][]byte)
+			mb.buckets[name] = b
+		}
+		for k := range c.deleted {
+			delete(b, k)
+		}
+		for k, v := range c.put {
+			b[k] = v
+		}
+	}
+	return nil
+}
+
+func (mb *memBackend) Close() error {
+	return nil
+}
+
+// memTx is a transaction on a memBackend. A writable transaction records the
+// keys it puts and deletes in each bucket it uses, which are applied to the
+// buckets on commit.
+type memTx struct {
+	mb       *memBackend
+	writable bool
+	written  map[string]*memChanges
+}
+
+// memChanges are the keys put and deleted in a bucket by a writable memTx.
+type memChanges struct {
+	put     map[string][]byte
+	deleted map[string]empty
+}
+
+func (t *memTx) Bucket(name string) (Bucket, error) {
+	if !t.writable {
+		return memBucket{t.mb.buckets[name], nil}, nil
+	}
+	c, ok := t.written[name]
+	if !ok {
+		c = &memChanges{make(map[string][]byte), make(map[string]empty)}
+		t.written[name] = c
+	}
+	return memBucket{t.mb.buckets[name], c}, nil
+}
+
+func (t *memTx) HasBucket(name string) bool {
+	if _, ok := t.written[name]; ok {
+		return true
+	}
+	_, ok := t.mb.buckets[name]
+	return ok
+}
+
+// memBucket is a bucket of a memBackend, along with the transaction's
+// changes to it, which are nil in a read-only transaction.
+type memBucket struct {
+	data    map[string][]byte
+	changes *memChanges
+}
+
+func (mb memBucket) Get(key []byte) []byte {
+	k := string(key)
+	if mb.changes != nil {
+		if v, ok := mb.changes.put[k]; ok {
+			return v
+		}
+		if _, ok := mb.changes.deleted[k]; ok {
+			return nil
+		}
+	}
+	return mb.data[k]
+}
+
+func (mb memBucket) Put(key []byte, value []byte) error {
+	if mb.changes == nil {
+		return ErrTxNotWritable
+	}
+	if len(key) == 0 {
+		return bolt.ErrKeyRequired
+	}
+	mb.changes.put[string(key)] = append([]byte(nil), value...)
+	delete(mb.changes.deleted, string(key))
+	return nil
+}
+
+func (mb memBucket) Delete(key []byte) error {
+	if mb.changes == nil {
+		return ErrTxNotWritable
+	}
+	delete(mb.changes.put, string(key))
+	mb.changes.deleted[string(key)] = empty{}
+	return nil
+}
+
+func (mb memBucket) keys() []string {
+	keys := make([]string, 0, len(mb.data))
+	for k := range mb.data {
+		if mb.changes != nil {
+			if _, ok := mb.changes.put[k]; ok {
+				continue
+			}
+			if _, ok := mb.changes.deleted[k]; ok {
+				continue
+			}
+		}
+		keys = append(keys, k)
+	}
+	if mb.changes != nil {
+		for k := range mb.changes.put {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (mb memBucket) Last() ([]byte, []byte) {
+	keys := mb.keys()
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	last := []byte(keys[len(keys)-1])
+	return last, mb.Get(last)
+}
+
+func (mb memBucket) ForEach(fn func(k, v []byte) error) error {
+	for _, k := range mb.keys() {
+		if err := fn([]byte(k), mb.Get([]byte(k))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package maimai
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// requiredFields lists the payload fields the protocol guarantees for each
+// inbound packet type. Packets missing any of them are malformed and are not
+// passed to handlers.
+var requiredFields = map[PacketType][]string{
+	PingEventType:        {"time"},
+	SendEventType:        {"id", "sender", "content"},
+	SendReplyType:        {"id", "sender", "content"},
+	NickEventType:        {"session_id", "from", "to"},
+	JoinEventType:        {"id", "name", "session_id"},
+	PartEventType:        {"id", "name", "session_id"},
+	LogReplyType:         {"log"},
+	EditMessageEventType: {"edit_id", "id"},
+	EditMessageReplyType: {"edit_id", "id"},
+	HelloEventType:       {"session"},
+	SnapshotEventType:    {"session_id"},
+	LoginReplyType:       {"success"},
+	AuthReplyType:        {"success"},
+	PMInitiateReplyType:  {"pm_id"},
+	PMInitiateEventType:  {"from", "pm_id"},
+}
+
+// ValidationError describes a malformed packet.
+type ValidationError struct {
+	Type PacketType
+	Msg  string
+}
+
+func (ve *ValidationError) Error() string {
+	return fmt.Sprintf("Malformed %s packet: %s", ve.Type, ve.Msg)
+}
+
+// ValidatePacket checks that the payload of a packet of a known type decodes
+// as the type it carries and has every field the protocol requires of it,
+// returning a *ValidationError if not. Top-level fields the payload type
+// does not know are returned, sorted, but are not an error. Packets with an
+// error set are replies to failed commands and need not have a payload. The
+// decoded payload is kept in the packet, to be returned by Payload.
+func ValidatePacket(packet *PacketEvent) ([]string, error) {
+	payload := newPayload(packet.Type)
+	if payload == nil || packet.Error != "" {
+		return nil, nil
+	}
+	required := requiredFields[packet.Type]
+	if len(packet.Data) == 0 {
+		if len(required) > 0 {
+			return nil, &ValidationError{packet.Type, "no payload"}
+		}
+		return nil, nil
+	}
+	if err := json.Unmarshal(packet.Data, payload); err != nil {
+		return nil, &ValidationError{packet.Type, err.Error()}
+	}
+	known := knownFields(reflect.TypeOf(payload).Elem())
+	var found uint
+	var unknown []string
+	isObject := objectKeys(packet.Data, func(key []byte) {
+		for i, name := range required {
+			if string(key) == name {
+				found |= 1 << uint(i)
+			}
+		}
+		if !known[string(key)] {
+			unknown = append(unknown, string(key))
+		}
+	})
+	if !isObject {
+		return nil, &ValidationError{packet.Type, "payload is not an object"}
+	}
+	for i, name := range required {
+		if found&(1<<uint(i)) == 0 {
+			return nil, &ValidationError{packet.Type, fmt.Sprintf("missing field '%s'", name)}
+		}
+	}
+	sort.Strings(unknown)
+	packet.payload = payload
+	return unknown, nil
+}
+
+// objectKeys calls fn with each top-level key of data, which must be valid
+// JSON, returning false if it is not an object. It scans data rather than
+// decoding it so that validating packets allocates little.
+func objectKeys(data []byte, fn func(key []byte)) bool {
+	i := 0
+	for i < len(data) && isJSONSpace(data[i]) {
+		i++
+	}
+	if i == len(data) || data[i] != '{' {
+		return false
+	}
+	depth := 0
+	for ; i < len(data); i++ {
+		switch data[i] {
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+		case '"':
+			start := i
+			escaped := false
+			for i++; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' {
+					escaped = true
+					i++
+				}
+			}
+			if depth != 1 {
+				continue
+			}
+			j := i + 1
+			for j < len(data) && isJSONSpace(data[j]) {
+				j++
+			}
+			if j == len(data) || data[j] != ':' {
+				continue
+			}
+			if !escaped {
+				fn(data[start+1 : i])
+				continue
+			}
+			var key string
+			if err := json.Unmarshal(data[start:i+1], &key); err == nil {
+				fn([]byte(key))
+			}
+		}
+	}
+	return true
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+var knownFieldsCache = struct {
+	sync.Mutex
+	m map[reflect.Type]map[string]bool
+}{m: make(map[reflect.Type]map[string]bool)}
+
+// knownFields returns the JSON names of the fields of struct type t,
+// including those of embedded structs.
+func knownFields(t reflect.Type) map[string]bool {
+	knownFieldsCache.Lock()
+	defer knownFieldsCache.Unlock()
+	if known, ok := knownFieldsCache.m[t]; ok {
+		return known
+	}
+	known := make(map[string]bool)
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if f.Anonymous && name == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				add(ft)
+				continue
+			}
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			known[name] = true
+		}
+	}
+	add(t)
+	knownFieldsCache.m[t] = known
+	return known
+}
+
+// PacketStats counts the inbound packets a room could not fully understand.
+type PacketStats struct {
+	// Malformed counts, by type, packets that failed ValidatePacket.
+	Malformed map[PacketType]int
+	// UnknownTypes counts packets of types this package does not know.
+	UnknownTypes map[PacketType]int
+	// UnknownFields counts, by type, packets with fields their payload type
+	// does not know.
+	UnknownFields map[PacketType]int
+}
+
+// packetValidator validates a room's inbound packets, keeping PacketStats
+// and logging each unknown type and field once to show protocol changes.
+type packetValidator struct {
+	sync.Mutex
+	stats    PacketStats
+	reported map[string]empty
+}
+
+func newPacketValidator() *packetValidator {
+	return &packetValidator{
+		stats: PacketStats{
+			Malformed:     make(map[PacketType]int),
+			UnknownTypes:  make(map[PacketType]int),
+			UnknownFields: make(map[PacketType]int),
+		},
+		reported: make(map[string]empty),
+	}
+}
+
+// firstReport returns true the first time it is called with key.
+func (v *packetValidator) firstReport(key string) bool {
+	if _, ok := v.reported[key]; ok {
+		return false
+	}
+	v.reported[key] = empty{}
+	return true
+}
+
+// validatePacket validates an inbound packet, returning false if it is
+// malformed and should not be passed to handlers.
+func (r *Room) validatePacket(packet *PacketEvent) bool {
+	v := r.validator
+	unknown, err := ValidatePacket(packet)
+	v.Lock()
+	defer v.Unlock()
+	if err != nil {
+		v.stats.Malformed[packet.Type]++
+		r.Logger.Warningf("%s: %s", err, packet.Data)
+		return false
+	}
+	if newPayload(packet.Type) == nil {
+		v.stats.UnknownTypes[packet.Type]++
+		if v.firstReport(string(packet.Type)) {
+			r.Logger.Warningf("Received packet of unknown type %s: %s", packet.Type, packet.Data)
+		}
+		return true
+	}
+	if len(unknown) > 0 {
+		v.stats.UnknownFields[packet.Type]++
+		for _, name := range unknown {
+			if v.firstReport(string(packet.Type) + "." + name) {
+				r.Logger.Warningf("Received %s packet with unknown field '%s'.", packet.Type, name)
+			}
+		}
+	}
+	return true
+}
+
+// PacketStats returns counts of the inbound packets the room could not fully
+// understand since it was created.
+func (r *Room) PacketStats() PacketStats {
+	v := r.validator
+	v.Lock()
+	defer v.Unlock()
+	stats := newPacketValidator().stats
+	for t, n := range v.stats.Malformed {
+		stats.Malformed[t] = n
+	}
+	for t, n := range v.stats.UnknownTypes {
+		stats.UnknownTypes[t] = n
+	}
+	for t, n := range v.stats.UnknownFields {
+		stats.UnknownFields[t] = n
+	}
+	return stats
+}